@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+//`kycli agent` is ssh-agent for UFKYC passports. It's handed one profile's API
+//token once, then listens on a Unix socket and makes API requests with it for
+//any kycli that finds the socket in $KYCLI_AGENT_SOCK, so they don't have to
+//unlock the credential store themselves. The token itself never leaves the
+//agent. After --idle-timeout without requests the agent forgets the token and
+//is "locked" until some kycli unlocks the credential store again.
+
+type agentRequest struct {
+	// Op is one of status, post, unlock, lock or stop.
+	Op      string `json:"op"`
+	Profile string `json:"profile,omitempty"`
+	// Username, UserID and Token are sent with unlock.
+	Username string     `json:"username,omitempty"`
+	UserID   uint       `json:"user_id,omitempty"`
+	Token    string     `json:"token,omitempty"`
+	URI      string     `json:"uri,omitempty"`
+	Form     url.Values `json:"form,omitempty"`
+}
+
+type agentResponse struct {
+	Error    string `json:"error,omitempty"`
+	Profile  string `json:"profile"`
+	Username string `json:"username,omitempty"`
+	UserID   uint   `json:"user_id,omitempty"`
+	Locked   bool   `json:"locked"`
+	// Status and Body are the API's answer to a post.
+	Status int    `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+var agentSocketFlag string
+
+// agentSocket is the agent we were pointed at, if any. Without
+// $KYCLI_AGENT_SOCK we still look for one in the default place, since the
+// browser doesn't pass our environment on to the native host.
+func agentSocket() string {
+	if agentSocketFlag != "" {
+		return agentSocketFlag
+	} else if sock := os.Getenv("KYCLI_AGENT_SOCK"); sock != "" {
+		return sock
+	} else if checkAgentSocket(defaultAgentSocket()) == nil {
+		return defaultAgentSocket()
+	}
+	return ""
+}
+
+// defaultAgentSocket lives in $XDG_RUNTIME_DIR when there is one, since only
+// we can get in there. Otherwise it's in a directory of ours in the shared
+// temp dir, which checkAgentDir makes sure nobody else made first.
+func defaultAgentSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "kycli-agent.sock")
+	}
+	return filepath.Join(fallbackAgentDir(), "agent.sock")
+}
+
+func fallbackAgentDir() string {
+	return filepath.Join(os.TempDir(), "kycli-"+strconv.Itoa(os.Getuid()))
+}
+
+// ownedByUs checks that info is for a file of our own user's.
+func ownedByUs(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
+
+// checkAgentDir refuses the fallback directory for sock unless it's a real
+// directory that's ours and shut to everyone else; otherwise another local
+// user could make it and listen there for our token.
+func checkAgentDir(sock string) error {
+	dir := filepath.Dir(sock)
+	if dir != fallbackAgentDir() {
+		return nil
+	} else if info, err := os.Lstat(dir); err != nil {
+		return err
+	} else if !info.IsDir() || !ownedByUs(info) {
+		return errors.New(dir + " isn't a directory of ours; remove it, or set $KYCLI_AGENT_SOCK")
+	} else if info.Mode().Perm() != 0700 {
+		return errors.New(dir + " is open to other users; chmod it 700, or remove it")
+	}
+	return nil
+}
+
+// checkAgentSocket makes sure sock is one of our own user's sockets, so we
+// don't hand a token to an agent someone else is running.
+func checkAgentSocket(sock string) error {
+	if err := checkAgentDir(sock); err != nil {
+		return err
+	} else if info, err := os.Lstat(sock); err != nil {
+		return err
+	} else if info.Mode()&os.ModeSocket == 0 {
+		return errors.New("it isn't a socket")
+	} else if !ownedByUs(info) {
+		return errors.New("the socket belongs to another user")
+	}
+	return nil
+}
+
+func agentCall(sock string, req agentRequest) (agentResponse, error) {
+	var resp agentResponse
+	w := exitWrapper(exitEnvironment, "error talking to kycli agent at "+sock)
+	if err := checkAgentSocket(sock); err != nil {
+		return resp, w(err)
+	}
+	conn, err := net.DialTimeout("unix", sock, 2*time.Second)
+	if err != nil {
+		return resp, w(err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, w(err)
+	} else if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return resp, w(err)
+	} else if resp.Error != "" {
+		return resp, w(errors.New(resp.Error))
+	}
+	return resp, nil
+}
+
+// agentUser is the user an unlocked agent is serving for conf's profile, if
+// there's such an agent.
+func agentUser(conf *Config) *User {
+	sock := agentSocket()
+	if sock == "" {
+		return nil
+	} else if resp, err := agentCall(sock, agentRequest{Op: "status", Profile: conf.Name}); err != nil || resp.Locked || resp.Profile != conf.Name {
+		return nil
+	} else {
+		user := &User{Name: resp.Username, agentSock: sock}
+		user.ID = resp.UserID
+		return user
+	}
+}
+
+// offerToAgent unlocks a locked agent for conf's profile with the token we
+// just had to unlock ourselves, so the next kycli doesn't have to.
+func offerToAgent(conf *Config, user *User) {
+	sock := agentSocket()
+	if sock == "" {
+		return
+	} else if resp, err := agentCall(sock, agentRequest{Op: "status"}); err != nil || !resp.Locked || resp.Profile != conf.Name {
+		return
+	} else if _, err := agentCall(sock, agentRequest{Op: "unlock", Profile: conf.Name, Username: user.Name, UserID: user.ID, Token: user.ApiToken}); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+}
+
+// agentPost is postForm for users served by an agent.
+func agentPost(u *User, profile string, uri string, vals url.Values) (*http.Response, error) {
+	if resp, err := agentCall(u.agentSock, agentRequest{Op: "post", Profile: profile, URI: uri, Form: vals}); err != nil {
+		return nil, err
+	} else {
+		return &http.Response{StatusCode: resp.Status, Body: ioutil.NopCloser(strings.NewReader(resp.Body))}, nil
+	}
+}
+
+// agentState is what the agent knows. The endpoint is fixed when it starts;
+// everything else changes with unlock and lock.
+type agentState struct {
+	mu       sync.Mutex
+	Profile  string        `json:"profile"`
+	Endpoint string        `json:"endpoint"`
+	Username string        `json:"username"`
+	UserID   uint          `json:"user_id"`
+	Token    string        `json:"token"`
+	Idle     time.Duration `json:"idle"`
+	timer    *time.Timer
+}
+
+// touch restarts the idle timer.
+func (st *agentState) touch() {
+	if st.Idle <= 0 {
+		return
+	} else if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.timer = time.AfterFunc(st.Idle, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.Token = ""
+	})
+}
+
+func (st *agentState) handle(req agentRequest) (resp agentResponse, stop bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	resp.Profile = st.Profile
+	if req.Profile != "" && req.Profile != st.Profile {
+		resp.Error = "this agent serves the profile '" + st.Profile + "', not '" + req.Profile + "'"
+		resp.Locked = st.Token == ""
+		return resp, false
+	}
+	switch req.Op {
+	case "status":
+	case "unlock":
+		if req.Token == "" {
+			resp.Error = "unlock needs a token"
+		} else {
+			st.Username, st.UserID, st.Token = req.Username, req.UserID, req.Token
+			st.touch()
+		}
+	case "lock":
+		st.Token = ""
+	case "stop":
+		st.Token = ""
+		stop = true
+	case "post":
+		if st.Token == "" {
+			resp.Error = "the agent is locked"
+		} else if post, err := http.NewRequest("POST", st.Endpoint+req.URI, bytes.NewBufferString(req.Form.Encode())); err != nil {
+			resp.Error = err.Error()
+		} else {
+			st.touch()
+			post.Header.Set("Authorization", st.Token)
+			post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if r, err := http.DefaultClient.Do(post); err != nil {
+				resp.Error = err.Error()
+			} else if b, err := ioutil.ReadAll(r.Body); err != nil {
+				r.Body.Close()
+				resp.Error = err.Error()
+			} else {
+				r.Body.Close()
+				resp.Status, resp.Body = r.StatusCode, string(b)
+			}
+		}
+	default:
+		resp.Error = "unknown op '" + req.Op + "'"
+	}
+	resp.Locked = st.Token == ""
+	if !resp.Locked {
+		resp.Username, resp.UserID = st.Username, st.UserID
+	}
+	return resp, stop
+}
+
+// listenAgent makes the socket, clearing out a dead agent's if it finds one.
+func listenAgent(sock string) (net.Listener, error) {
+	w := exitWrapper(exitEnvironment, "error listening on "+sock)
+	if err := os.MkdirAll(filepath.Dir(sock), 0700); err != nil {
+		return nil, w(err)
+	} else if err := checkAgentDir(sock); err != nil {
+		return nil, w(err)
+	} else if _, err := agentCall(sock, agentRequest{Op: "status"}); err == nil {
+		return nil, w(errors.New("another agent is already listening there"))
+	} else if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+		return nil, w(err)
+	}
+	//The socket is only for us, from the moment it exists.
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	l, err := net.Listen("unix", sock)
+	return l, w(err)
+}
+
+// serveAgent answers requests until told to stop or signaled.
+func serveAgent(l net.Listener, st *agentState) {
+	sock := l.Addr().String()
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		select {
+		case <-signals:
+		case <-done:
+		}
+		l.Close()
+	}()
+	st.touch()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var req agentRequest
+			var resp agentResponse
+			stop := false
+			conn.SetDeadline(time.Now().Add(time.Minute))
+			if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+				resp.Error = "bad request: " + err.Error()
+			} else {
+				resp, stop = st.handle(req)
+			}
+			json.NewEncoder(conn).Encode(resp)
+			if stop {
+				close(done)
+			}
+		}(conn)
+	}
+	os.Remove(sock)
+}
+
+// agentDaemonCmd is the detached agent started by startAgent.
+var agentDaemonCmd = &cobra.Command{
+	Use:    "__agent [socket]",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var st agentState
+		if err := json.NewDecoder(os.Stdin).Decode(&st); err != nil {
+			fmt.Println("error reading agent state:", err)
+		} else if l, err := listenAgent(args[0]); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("ok")
+			os.Stdout.Close()
+			serveAgent(l, &st)
+			return
+		}
+		os.Exit(exitEnvironment)
+	},
+}
+
+// startAgent leaves a detached agent serving st on sock, returning its pid.
+func startAgent(sock string, st *agentState) (int, error) {
+	w := exitWrapper(exitEnvironment, "error starting agent")
+	self, err := os.Executable()
+	if err != nil {
+		return 0, w(err)
+	}
+	cmd := exec.Command(self, "__agent", sock)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, w(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, w(err)
+	} else if err := cmd.Start(); err != nil {
+		return 0, w(err)
+	} else if err := json.NewEncoder(stdin).Encode(st); err != nil {
+		return 0, w(err)
+	}
+	stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+		return 0, w(err, "agent died before it was ready")
+	} else if line = strings.TrimSpace(line); line != "ok" {
+		return 0, w(errors.New(line))
+	}
+	pid := cmd.Process.Pid
+	return pid, w(cmd.Process.Release())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/atotto/clipboard"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+//A token left in the clipboard is a token anything can paste, and clipboard
+//managers keep a copy forever. So once it's had time to be pasted we put back
+//whatever was there before, unless the user has copied something else since.
+
+var (
+	clipboardTimeout time.Duration
+	clipboardRestore bool
+	clipboardWait    bool
+)
+
+// clipboardClear is what the background clearer needs to know. It's passed on
+// stdin so the token never shows up in ps.
+type clipboardClear struct {
+	Token    string        `json:"token"`
+	Previous string        `json:"previous"`
+	After    time.Duration `json:"after"`
+}
+
+// clearClipboard puts c.Previous back, or empties the clipboard, if it still
+// holds c.Token.
+func clearClipboard(c clipboardClear) error {
+	if current, err := clipboard.ReadAll(); err != nil {
+		return errors.Wrap(err, "error reading clipboard")
+	} else if current != c.Token {
+		return nil
+	} else if err := clipboard.WriteAll(c.Previous); err != nil {
+		return errors.Wrap(err, "error clearing clipboard")
+	}
+	return nil
+}
+
+// clearClipboardLater arranges for the token to leave the clipboard after
+// --clipboard-timeout, either by waiting here or by leaving a detached copy
+// of kycli behind to do it.
+func clearClipboardLater(token string, previous string) error {
+	if clipboardTimeout <= 0 {
+		return nil
+	}
+	c := clipboardClear{Token: token, After: clipboardTimeout}
+	if clipboardRestore {
+		c.Previous = previous
+	}
+	if clipboardWait {
+		fmt.Println("Clearing the clipboard in " + clipboardTimeout.String() + "; press Ctrl-C to leave the token there.")
+		time.Sleep(clipboardTimeout)
+		if err := clearClipboard(c); err != nil {
+			return err
+		}
+		fmt.Println("Clipboard cleared.")
+		return nil
+	}
+	w := errWrapper("error starting background clipboard clearer")
+	self, err := os.Executable()
+	if err != nil {
+		return w(err)
+	}
+	cmd := exec.Command(self, "__clear-clipboard")
+	//Its own session, so closing the terminal doesn't take it down with it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if stdin, err := cmd.StdinPipe(); err != nil {
+		return w(err)
+	} else if err := cmd.Start(); err != nil {
+		return w(err)
+	} else if err := json.NewEncoder(stdin).Encode(c); err != nil {
+		return w(err)
+	} else if err := stdin.Close(); err != nil {
+		return w(err)
+	} else if err := cmd.Process.Release(); err != nil {
+		return w(err)
+	}
+	fmt.Println("The clipboard will be cleared in " + clipboardTimeout.String() + ".")
+	return nil
+}
+
+// clearClipboardCmd is the detached clearer started by clearClipboardLater.
+var clearClipboardCmd = &cobra.Command{
+	Use:    "__clear-clipboard",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var c clipboardClear
+		if err := json.NewDecoder(os.Stdin).Decode(&c); err != nil {
+			os.Exit(exitUsage)
+		}
+		time.Sleep(c.After)
+		if clearClipboard(c) != nil {
+			os.Exit(exitEnvironment)
+		}
+	},
+}
+
+// registerClipboardFlags adds the clipboard clearing flags to commands that
+// put tokens in the clipboard.
+func registerClipboardFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&clipboardTimeout, "clipboard-timeout", 45*time.Second, "Take the token out of the clipboard after this long (0 leaves it there)")
+	cmd.Flags().BoolVar(&clipboardRestore, "clipboard-restore", true, "Put back what was in the clipboard before, instead of emptying it")
+	cmd.Flags().BoolVar(&clipboardWait, "clipboard-wait", false, "Wait in the foreground to clear the clipboard, instead of leaving a background process to do it")
+}
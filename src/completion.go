@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+)
+
+//Dynamic shell completion. These run inside the hidden __complete command
+//while the user is typing, so they must never prompt or print; anything that
+//goes wrong just means no suggestions.
+
+func completeProfiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var names []string
+	withProfiles(func(profiles []Config) {
+		for _, p := range profiles {
+			names = append(names, p.Name)
+		}
+	}, func(error) {})
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeDomains suggests domains that were used from this machine before,
+// either by a service or in the token history.
+func completeDomains(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var names []string
+	withDB(func(db *gorm.DB) {
+		var services, issued []string
+		db.Model(&ServiceDomain{}).Distinct().Pluck("name", &services)
+		db.Model(&TokenIssue{}).Distinct().Pluck("domain", &issued)
+		seen := map[string]bool{}
+		for _, name := range append(services, issued...) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}, func(error) {})
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeHistoryDomains suggests domains from the token history.
+func completeHistoryDomains(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var names []string
+	withDB(func(db *gorm.DB) {
+		db.Model(&TokenIssue{}).Distinct().Order("domain").Pluck("domain", &names)
+	}, func(error) {})
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeServiceIDs suggests the IDs and aliases of the services the current
+// profile's passport owns.
+func completeServiceIDs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var ids []string
+	withConfig(func(conf *Config) {
+		var services []Service
+		db.Where("user_id = ?", conf.UserID).Order("id").Find(&services)
+		for _, svc := range services {
+			ids = append(ids, svc.ServiceID)
+			if svc.Alias != "" {
+				ids = append(ids, svc.Alias)
+			}
+		}
+	}, func(error) {})
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// onlyFirstArg limits a completion function to the first positional argument.
+func onlyFirstArg(f func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective)) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return f(cmd, args, toComplete)
+	}
+}
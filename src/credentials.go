@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+//API tokens are as good as a password, so where they live is up to the user.
+//Each profile picks one of these backends; the User row itself only keeps the
+//token when the profile uses the "sqlite" backend.
+
+type credentialStore interface {
+	Get(user *User) (string, error)
+	Set(user *User, token string) error
+	Delete(user *User) error
+}
+
+var credentialBackends = []string{"sqlite", "file", "exec"}
+
+func credentialStoreFor(conf *Config) (credentialStore, error) {
+	switch conf.CredentialBackend {
+	case "", "sqlite":
+		return sqliteCredentialStore{}, nil
+	case "file":
+		return &fileCredentialStore{}, nil
+	case "exec":
+		if args := credentialArgv(conf.CredentialCommand); len(args) == 0 {
+			return nil, errors.New("profile uses the exec credential backend, but has no command configured")
+		} else {
+			return execCredentialStore{args: args, endpoint: conf.ApiEndpoint}, nil
+		}
+	default:
+		return nil, errors.New("unknown credential backend '" + conf.CredentialBackend + "'")
+	}
+}
+
+// credentialArgv reads Config.CredentialCommand, which holds the helper's argv
+// as a JSON array. Profiles from before that hold it joined with spaces.
+func credentialArgv(command string) []string {
+	var args []string
+	if err := json.Unmarshal([]byte(command), &args); err != nil {
+		return strings.Fields(command)
+	}
+	return args
+}
+
+// encodeCredentialArgv is credentialArgv's inverse.
+func encodeCredentialArgv(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(args)
+	return string(b)
+}
+
+// describeCredentialArgv shows args the way you'd type them into a shell.
+func describeCredentialArgv(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\$`|&;<>()*?[]#~") {
+			quoted[i] = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		} else {
+			quoted[i] = a
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// credentialKey names a user's token inside stores shared between profiles.
+func credentialKey(user *User) string {
+	return strconv.Itoa(int(user.ID)) + ":" + user.Name
+}
+
+type sqliteCredentialStore struct{}
+
+func (sqliteCredentialStore) Get(user *User) (string, error) {
+	return user.StoredToken, nil
+}
+
+func (sqliteCredentialStore) Set(user *User, token string) error {
+	user.StoredToken = token
+	return db.Model(user).Update("api_token", token).Error
+}
+
+func (sqliteCredentialStore) Delete(user *User) error {
+	user.StoredToken = ""
+	return db.Model(user).Update("api_token", "").Error
+}
+
+// fileCredentialStore keeps every profile's token in one file, encrypted with
+// XChaCha20-Poly1305 under a scrypt derived key.
+type fileCredentialStore struct{}
+
+type encryptedCredentials struct {
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+const credentialsAD = "kycli credentials v1"
+
+// credentialsPassphrase is cached so a command only asks once.
+var credentialsPassphrase string
+
+func credentialsFilePath() (string, error) {
+	var path string
+	var pathErr error
+	withDBPath(func(string) {
+		if err := os.MkdirAll(dbpath, 0700); err != nil {
+			pathErr = err
+		}
+		path = dbpath + "credentials.enc"
+	}, func(err error) {
+		pathErr = err
+	})
+	return path, pathErr
+}
+
+func getCredentialsPassphrase(confirm bool) (string, error) {
+	if credentialsPassphrase != "" {
+		return credentialsPassphrase, nil
+	} else if p := os.Getenv("KYCLI_PASSPHRASE"); p != "" {
+		credentialsPassphrase = p
+		return p, nil
+	} else if nonInteractive {
+		return "", errNeedsInput("credentials passphrase", "$KYCLI_PASSPHRASE")
+	}
+	fmt.Print("Credentials passphrase: ")
+	if p, err := secureTermRead(); err != nil {
+		return "", errors.Wrap(err, "error reading passphrase from terminal")
+	} else if p == "" {
+		return "", errors.New("the passphrase can't be empty")
+	} else if confirm {
+		fmt.Print("Confirm passphrase: ")
+		if c, err := secureTermRead(); err != nil {
+			return "", errors.Wrap(err, "error reading passphrase from terminal")
+		} else if c != p {
+			return "", errors.New("passphrases were not the same")
+		}
+		credentialsPassphrase = p
+		return p, nil
+	} else {
+		credentialsPassphrase = p
+		return p, nil
+	}
+}
+
+func (s *fileCredentialStore) load() (map[string]string, error) {
+	w := errWrapper("error reading encrypted credentials")
+	var env encryptedCredentials
+	tokens := map[string]string{}
+	if path, err := credentialsFilePath(); err != nil {
+		return nil, w(err, "couldn't find credentials file")
+	} else if b, err := ioutil.ReadFile(path); os.IsNotExist(err) {
+		return tokens, nil
+	} else if err != nil {
+		return nil, w(err)
+	} else if err := json.Unmarshal(b, &env); err != nil {
+		return nil, w(err, "credentials file is corrupt")
+	} else if env.KDF != "scrypt" {
+		return nil, w(errors.New("unsupported key derivation function '" + env.KDF + "'"))
+	} else if passphrase, err := getCredentialsPassphrase(false); err != nil {
+		return nil, w(err)
+	} else if key, err := scrypt.Key([]byte(passphrase), env.Salt, env.N, env.R, env.P, chacha20poly1305.KeySize); err != nil {
+		return nil, w(err, "error deriving key")
+	} else if aead, err := chacha20poly1305.NewX(key); err != nil {
+		return nil, w(err)
+	} else if plain, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(credentialsAD)); err != nil {
+		credentialsPassphrase = ""
+		return nil, w(errors.New("wrong passphrase, or the file was tampered with"))
+	} else if err := json.Unmarshal(plain, &tokens); err != nil {
+		return nil, w(err, "decrypted credentials are corrupt")
+	} else {
+		return tokens, nil
+	}
+}
+
+func (s *fileCredentialStore) save(tokens map[string]string) error {
+	w := errWrapper("error writing encrypted credentials")
+	path, err := credentialsFilePath()
+	if err != nil {
+		return w(err, "couldn't find credentials file")
+	}
+	_, statErr := os.Stat(path)
+	env := encryptedCredentials{KDF: "scrypt", N: 1 << 15, R: 8, P: 1, Salt: make([]byte, 16), Nonce: make([]byte, chacha20poly1305.NonceSizeX)}
+	if plain, err := json.Marshal(tokens); err != nil {
+		return w(err)
+	} else if passphrase, err := getCredentialsPassphrase(os.IsNotExist(statErr)); err != nil {
+		return w(err)
+	} else if _, err := rand.Read(env.Salt); err != nil {
+		return w(err, "error gathering salt entropy")
+	} else if _, err := rand.Read(env.Nonce); err != nil {
+		return w(err, "error gathering nonce entropy")
+	} else if key, err := scrypt.Key([]byte(passphrase), env.Salt, env.N, env.R, env.P, chacha20poly1305.KeySize); err != nil {
+		return w(err, "error deriving key")
+	} else if aead, err := chacha20poly1305.NewX(key); err != nil {
+		return w(err)
+	} else {
+		env.Ciphertext = aead.Seal(nil, env.Nonce, plain, []byte(credentialsAD))
+	}
+	if b, err := json.Marshal(env); err != nil {
+		return w(err)
+	} else if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return w(err)
+	} else if err := os.Rename(path+".tmp", path); err != nil {
+		return w(err)
+	}
+	return nil
+}
+
+func (s *fileCredentialStore) Get(user *User) (string, error) {
+	if tokens, err := s.load(); err != nil {
+		return "", err
+	} else {
+		return tokens[credentialKey(user)], nil
+	}
+}
+
+func (s *fileCredentialStore) Set(user *User, token string) error {
+	if tokens, err := s.load(); err != nil {
+		return err
+	} else {
+		tokens[credentialKey(user)] = token
+		return s.save(tokens)
+	}
+}
+
+func (s *fileCredentialStore) Delete(user *User) error {
+	if tokens, err := s.load(); err != nil {
+		return err
+	} else if _, ok := tokens[credentialKey(user)]; !ok {
+		return nil
+	} else {
+		delete(tokens, credentialKey(user))
+		return s.save(tokens)
+	}
+}
+
+// execCredentialStore speaks the git-credential helper protocol, so anything
+// from `git credential-store` to a wrapper around `pass` can hold the tokens.
+// The command is run with "get", "store" or "erase" appended.
+type execCredentialStore struct {
+	args     []string
+	endpoint string
+}
+
+func (s execCredentialStore) run(action string, user *User, token string) (string, error) {
+	w := errWrapper("error running credential helper")
+	args := s.args
+	var in bytes.Buffer
+	host := s.endpoint
+	if u, err := url.Parse(s.endpoint); err == nil {
+		host = u.Host
+	}
+	fmt.Fprintf(&in, "protocol=kycli\nhost=%s\nusername=%s\n", host, credentialKey(user))
+	if token != "" {
+		fmt.Fprintf(&in, "password=%s\n", token)
+	}
+	in.WriteString("\n")
+	cmd := exec.Command(args[0], append(args[1:], action)...)
+	cmd.Stdin = &in
+	cmd.Stderr = os.Stderr
+	if out, err := cmd.Output(); err != nil {
+		return "", w(err, "'"+describeCredentialArgv(args)+" "+action+"' failed")
+	} else {
+		return string(out), nil
+	}
+}
+
+func (s execCredentialStore) Get(user *User) (string, error) {
+	out, err := s.run("get", user, "")
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "password=") {
+			return strings.TrimPrefix(line, "password="), nil
+		}
+	}
+	return "", nil
+}
+
+func (s execCredentialStore) Set(user *User, token string) error {
+	_, err := s.run("store", user, token)
+	return err
+}
+
+func (s execCredentialStore) Delete(user *User) error {
+	_, err := s.run("erase", user, "")
+	return err
+}
+
+// saveLogin records a freshly issued API token as the profile's passport. Logging
+// in again as the same user just replaces the token.
+func saveLogin(conf *Config, username string, token string) error {
+	w := exitWrapper(exitStorage, "error saving user into configuration")
+	store, err := credentialStoreFor(conf)
+	if err != nil {
+		return w(err)
+	} else if conf.User.ID != 0 && conf.User.Name == username {
+		if err := store.Set(&conf.User, token); err != nil {
+			return w(err, "error storing api token")
+		}
+		conf.User.ApiToken = token
+		return nil
+	} else if conf.User.ID != 0 {
+		//Someone else's passport; theirs goes, services and all.
+		if err := forgetLogin(conf); err != nil {
+			return err
+		}
+	}
+	conf.User.Name = username
+	if err := db.Save(&conf.User).Error; err != nil {
+		return w(err)
+	}
+	conf.UserID = conf.User.ID
+	if err := db.Save(conf).Error; err != nil {
+		return w(err)
+	} else if err := store.Set(&conf.User, token); err != nil {
+		return w(err, "error storing api token")
+	}
+	conf.User.ApiToken = token
+	return nil
+}
+
+// forgetLogin removes the profile's user along with its API token and
+// everything we synced for it, for logging out. sqlite hands the user's ID
+// out again, so anything left behind would turn up for whoever logs in next.
+// Logging in again as the same user goes through saveLogin instead, which
+// keeps all that.
+func forgetLogin(conf *Config) error {
+	w := exitWrapper(exitStorage, "error removing user from configuration")
+	if store, err := credentialStoreFor(conf); err != nil {
+		return w(err)
+	} else if err := store.Delete(&conf.User); err != nil {
+		return w(err, "error removing api token from credential store")
+	} else if err := db.Model(conf).Omit("User").Updates(map[string]interface{}{"user_id": 0, "default_service": ""}).Error; err != nil {
+		return w(err)
+	} else if err := db.Unscoped().Where("user_id = ?", conf.User.ID).Delete(&Service{}).Error; err != nil {
+		return w(err)
+	} else if err := db.Unscoped().Where("user_id = ?", conf.User.ID).Delete(&ServiceDomain{}).Error; err != nil {
+		return w(err)
+	} else if err := db.Unscoped().Delete(&conf.User).Error; err != nil {
+		return w(err)
+	}
+	conf.UserID = 0
+	conf.DefaultService = ""
+	conf.User = User{}
+	return nil
+}
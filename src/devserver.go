@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"unofficialkyc.com/kycli/verify"
+)
+
+//The devserver is a toy, in-memory implementation of the UFKYC API for testing
+//kycli and service integrations offline. It hands out real, verifiable tokens,
+//but payments always "succeed" and domains are validated a fixed delay after
+//they're registered (right away by default), since it has no way of reaching
+//them.
+
+const devServerPrefix = "/api/v1"
+
+// defaultValidationWindow is how long a registered domain has to be validated
+// before it's dropped.
+const defaultValidationWindow = time.Hour
+
+type devUser struct {
+	Name     string
+	Password string
+	Donated  float64
+}
+
+type devDomain struct {
+	Name       string
+	Path       string
+	Content    string
+	Nonce      string
+	Registered time.Time
+	Expires    time.Time
+	// ValidatedAt is when the domain passes validation; zero if it never
+	// will.
+	ValidatedAt time.Time
+}
+
+// state is pending, validated or expired.
+func (d *devDomain) state(now time.Time) string {
+	if !d.ValidatedAt.IsZero() && !now.Before(d.ValidatedAt) {
+		return "validated"
+	} else if !now.Before(d.Expires) {
+		return "expired"
+	}
+	return "pending"
+}
+
+type devAPIToken struct {
+	ID       string
+	Owner    string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+type devService struct {
+	ID               string
+	Owner            string
+	Registered       time.Time
+	RequiredDonation float64
+	Domains          map[string]*devDomain
+}
+
+type devServer struct {
+	sync.Mutex
+	key       ed25519.PrivateKey
+	users     map[string]*devUser
+	apiTokens map[string]*devAPIToken
+	services  map[string]*devService
+	//serviceOrder remembers registration order, so "the user's service" is
+	//their most recent one.
+	serviceOrder []string
+	donations    map[string]float64
+	//validationDelay is how long domains take to validate; a delay past
+	//validationWindow means they never do.
+	validationDelay  time.Duration
+	validationWindow time.Duration
+}
+
+func newDevServer(key ed25519.PrivateKey) *devServer {
+	return &devServer{
+		key:       key,
+		users:     map[string]*devUser{},
+		apiTokens: map[string]*devAPIToken{},
+		services:  map[string]*devService{},
+		donations: map[string]float64{},
+
+		validationWindow: defaultValidationWindow,
+	}
+}
+
+// loadDevServerKey reads a hex encoded ed25519 seed from path, creating one if
+// the file doesn't exist. An empty path gets a throwaway key.
+func loadDevServerKey(path string) (ed25519.PrivateKey, error) {
+	w := errWrapper("error loading devserver signing key")
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(nil)
+		return key, err
+	} else if b, err := ioutil.ReadFile(path); os.IsNotExist(err) {
+		if _, key, err := ed25519.GenerateKey(nil); err != nil {
+			return nil, w(err, "error generating key")
+		} else if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, w(err, "error saving new key")
+		} else {
+			return key, nil
+		}
+	} else if err != nil {
+		return nil, w(err, "error reading key file")
+	} else if seed, err := hex.DecodeString(strings.TrimSpace(string(b))); err != nil || len(seed) != ed25519.SeedSize {
+		return nil, w(errors.New("key file must contain a hex encoded 32 byte ed25519 seed"))
+	} else {
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+}
+
+func (s *devServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(path string, authed bool, f func(w http.ResponseWriter, r *http.Request, user *devUser)) {
+		mux.HandleFunc(devServerPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+			log.Println(r.Method, r.URL.Path)
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "couldn't parse form", http.StatusBadRequest)
+				return
+			}
+			s.Lock()
+			defer s.Unlock()
+			var user *devUser
+			if authed {
+				if t, ok := s.apiTokens[r.Header.Get("Authorization")]; !ok {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				} else {
+					t.LastUsed = time.Now()
+					user = s.users[t.Owner]
+				}
+			}
+			f(w, r, user)
+		})
+	}
+	handle("/public_key", false, s.publicKey)
+	handle("/register", false, s.register)
+	handle("/new_api_token", false, s.newAPIToken)
+	handle("/get_account_token", true, s.getAccountToken)
+	handle("/list_api_tokens", true, s.listAPITokens)
+	handle("/revoke_api_token", true, s.revokeAPIToken)
+	handle("/donate", true, s.donate)
+	handle("/register_service", true, s.registerService)
+	handle("/register_service_domain", true, s.registerServiceDomain)
+	handle("/require_donation", true, s.requireDonation)
+	handle("/service_domain_status", true, s.serviceDomainStatus)
+	handle("/list_services", true, s.listServices)
+	mux.HandleFunc("/checkout/", s.checkout)
+	return mux
+}
+
+func (s *devServer) publicKey(w http.ResponseWriter, r *http.Request, _ *devUser) {
+	fmt.Fprintln(w, hex.EncodeToString(s.key.Public().(ed25519.PublicKey)))
+}
+
+func (s *devServer) issueAPIToken(w http.ResponseWriter, name string) {
+	token := mustRandString(32)
+	now := time.Now()
+	s.apiTokens[token] = &devAPIToken{ID: mustRandString(8), Owner: name, Created: now, LastUsed: now}
+	fmt.Fprint(w, token)
+}
+
+func (s *devServer) register(w http.ResponseWriter, r *http.Request, _ *devUser) {
+	name, password := r.PostForm.Get("username"), r.PostForm.Get("password")
+	if name == "" || password == "" {
+		http.Error(w, "username and password are required", http.StatusBadRequest)
+	} else if _, ok := s.users[name]; ok {
+		//kycli compares this body verbatim, so no trailing newline.
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "user already exists")
+	} else {
+		s.users[name] = &devUser{Name: name, Password: password}
+		s.issueAPIToken(w, name)
+	}
+}
+
+func (s *devServer) newAPIToken(w http.ResponseWriter, r *http.Request, _ *devUser) {
+	if user, ok := s.users[r.PostForm.Get("username")]; !ok || !hmac.Equal([]byte(user.Password), []byte(r.PostForm.Get("password"))) {
+		http.Error(w, "incorrect username or password", http.StatusUnauthorized)
+	} else {
+		s.issueAPIToken(w, user.Name)
+	}
+}
+
+func (s *devServer) listAPITokens(w http.ResponseWriter, r *http.Request, user *devUser) {
+	type session struct {
+		ID         string    `json:"id"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		Current    bool      `json:"current"`
+	}
+	var resp struct {
+		Data []session `json:"data"`
+	}
+	resp.Data = []session{}
+	for k, t := range s.apiTokens {
+		if t.Owner == user.Name {
+			resp.Data = append(resp.Data, session{t.ID, t.Created, t.LastUsed, k == r.Header.Get("Authorization")})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// revokeAPIToken revokes the token identified by token_id, or the caller's own
+// token if none is given.
+func (s *devServer) revokeAPIToken(w http.ResponseWriter, r *http.Request, user *devUser) {
+	id := r.PostForm.Get("token_id")
+	if id == "" {
+		delete(s.apiTokens, r.Header.Get("Authorization"))
+		return
+	}
+	for k, t := range s.apiTokens {
+		if t.ID == id && t.Owner == user.Name {
+			delete(s.apiTokens, k)
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "no api token with that id")
+}
+
+// requestedService is the service_id a request names, which has to be one of
+// user's. Without one it's their latest service, like the API before it took
+// service_id.
+func (s *devServer) requestedService(r *http.Request, user *devUser) *devService {
+	if id := r.PostForm.Get("service_id"); id != "" {
+		if svc, ok := s.services[id]; ok && svc.Owner == user.Name {
+			return svc
+		}
+		return nil
+	}
+	return s.latestService(user.Name)
+}
+
+// latestService is the service register_domain and require_donation act on
+// when not told which.
+func (s *devServer) latestService(owner string) *devService {
+	for i := len(s.serviceOrder) - 1; i >= 0; i-- {
+		if svc := s.services[s.serviceOrder[i]]; svc.Owner == owner {
+			return svc
+		}
+	}
+	return nil
+}
+
+func (s *devServer) getAccountToken(w http.ResponseWriter, r *http.Request, user *devUser) {
+	domain := r.PostForm.Get("service_domain")
+	var svc *devService
+	for _, v := range s.services {
+		if d, ok := v.Domains[domain]; ok && d.state(time.Now()) == "validated" {
+			svc = v
+		}
+	}
+	if svc == nil {
+		http.Error(w, "no service has validated the domain "+domain, http.StatusNotFound)
+	} else if user.Donated < svc.RequiredDonation {
+		http.Error(w, fmt.Sprintf("this service requires you to have donated at least %0.2f$", svc.RequiredDonation), http.StatusPaymentRequired)
+	} else {
+		//Subjects have to be stable per user and service, but unlinkable
+		//between services.
+		mac := hmac.New(sha256.New, s.key.Seed())
+		mac.Write([]byte(svc.ID + "\x00" + user.Name))
+		now := time.Now().UTC().Truncate(time.Second)
+		if token, err := verify.Sign(s.key, &verify.Claims{
+			Issuer:     "kycli devserver",
+			Subject:    hex.EncodeToString(mac.Sum(nil)[:16]),
+			Audience:   svc.ID,
+			IssuedAt:   now,
+			NotBefore:  now,
+			Expiration: now.Add(time.Hour),
+			TokenID:    mustRandString(16),
+		}, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			fmt.Fprint(w, token)
+		}
+	}
+}
+
+func (s *devServer) donate(w http.ResponseWriter, r *http.Request, user *devUser) {
+	if amount, err := strconv.ParseFloat(r.PostForm.Get("amount"), 64); err != nil || amount <= 0 {
+		http.Error(w, "invalid amount", http.StatusBadRequest)
+	} else if vendor := r.PostForm.Get("payment_vendor"); vendor != "stripe" && vendor != "globee" {
+		http.Error(w, "unknown payment vendor", http.StatusBadRequest)
+	} else if vendor == "globee" && amount < 10 {
+		http.Error(w, "crypto donations must be at least 10$", http.StatusBadRequest)
+	} else if vendor == "globee" && r.PostForm.Get("email") == "" {
+		http.Error(w, "an email is required for crypto donations", http.StatusBadRequest)
+	} else {
+		//Nobody is actually paying anything, so the donation counts right away.
+		user.Donated += amount
+		id := mustRandString(16)
+		s.donations[id] = amount
+		fmt.Fprint(w, "http://"+r.Host+"/checkout/"+id)
+	}
+}
+
+func (s *devServer) checkout(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	amount, ok := s.donations[strings.TrimPrefix(r.URL.Path, "/checkout/")]
+	s.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+	} else {
+		fmt.Fprintf(w, "kycli devserver: your donation of %0.2f$ has been recorded. No money was moved.\n", amount)
+	}
+}
+
+func (s *devServer) registerService(w http.ResponseWriter, r *http.Request, user *devUser) {
+	svc := &devService{
+		ID:         mustRandString(16),
+		Owner:      user.Name,
+		Registered: time.Now(),
+		Domains:    map[string]*devDomain{},
+	}
+	s.services[svc.ID] = svc
+	s.serviceOrder = append(s.serviceOrder, svc.ID)
+	fmt.Fprint(w, svc.ID)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func (s *devServer) registerServiceDomain(w http.ResponseWriter, r *http.Request, user *devUser) {
+	name := strings.ToLower(r.PostForm.Get("domain_name"))
+	svc := s.requestedService(r, user)
+	if svc == nil {
+		writeJSONError(w, http.StatusBadRequest, "you have not registered that service")
+		return
+	} else if name == "" {
+		writeJSONError(w, http.StatusBadRequest, "domain_name is required")
+		return
+	}
+	for _, v := range s.services {
+		if _, ok := v.Domains[name]; ok && v != svc {
+			writeJSONError(w, http.StatusConflict, "that domain belongs to another service")
+			return
+		}
+	}
+	d, ok := svc.Domains[name]
+	if now := time.Now(); !ok || d.state(now) == "expired" {
+		d = &devDomain{
+			Name:       name,
+			Path:       "/.well-known/ufkyc/" + mustRandString(16),
+			Content:    mustRandString(32),
+			Nonce:      "ufkyc-validation=" + mustRandString(32),
+			Registered: now,
+			Expires:    now.Add(s.validationWindow),
+		}
+		if s.validationDelay < s.validationWindow {
+			d.ValidatedAt = now.Add(s.validationDelay)
+		}
+		svc.Domains[name] = d
+	}
+	var resp struct {
+		Data struct {
+			PathValidation struct {
+				Path    string `json:"path"`
+				Content string `json:"content"`
+			} `json:"path_validation"`
+			TxtValidation struct {
+				Nonce string `json:"nonce"`
+			} `json:"txt_validation"`
+		} `json:"data"`
+	}
+	resp.Data.PathValidation.Path = d.Path
+	resp.Data.PathValidation.Content = d.Content
+	resp.Data.TxtValidation.Nonce = d.Nonce
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *devServer) requireDonation(w http.ResponseWriter, r *http.Request, user *devUser) {
+	if svc := s.requestedService(r, user); svc == nil {
+		http.Error(w, "you have not registered that service", http.StatusBadRequest)
+	} else if amount, err := strconv.ParseFloat(r.PostForm.Get("amount"), 64); err != nil || amount < 0 {
+		http.Error(w, "invalid amount", http.StatusBadRequest)
+	} else {
+		svc.RequiredDonation = amount
+	}
+}
+
+// domainStatuses describes svc's domains, in order of name.
+func (svc *devService) domainStatuses(now time.Time) []domainStatus {
+	statuses := []domainStatus{}
+	for _, d := range svc.Domains {
+		status := domainStatus{
+			Domain:       d.Name,
+			ServiceID:    svc.ID,
+			State:        d.state(now),
+			RegisteredAt: d.Registered,
+			ExpiresAt:    d.Expires,
+		}
+		if status.State == "validated" {
+			status.ValidatedAt = d.ValidatedAt
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Domain < statuses[j].Domain })
+	return statuses
+}
+
+// serviceDomainStatus reports on domain_name, or on all of the user's domains
+// if it's empty.
+func (s *devServer) serviceDomainStatus(w http.ResponseWriter, r *http.Request, user *devUser) {
+	name := strings.ToLower(r.PostForm.Get("domain_name"))
+	var resp struct {
+		Data []domainStatus `json:"data"`
+	}
+	resp.Data = []domainStatus{}
+	for _, id := range s.serviceOrder {
+		if svc := s.services[id]; svc.Owner == user.Name {
+			for _, status := range svc.domainStatuses(time.Now()) {
+				if name == "" || status.Domain == name {
+					resp.Data = append(resp.Data, status)
+				}
+			}
+		}
+	}
+	if name != "" && len(resp.Data) == 0 {
+		writeJSONError(w, http.StatusNotFound, "none of your services registered that domain")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// listServices describes all of the user's services, oldest first.
+func (s *devServer) listServices(w http.ResponseWriter, r *http.Request, user *devUser) {
+	var resp struct {
+		Data []serviceListing `json:"data"`
+	}
+	resp.Data = []serviceListing{}
+	for _, id := range s.serviceOrder {
+		if svc := s.services[id]; svc.Owner == user.Name {
+			resp.Data = append(resp.Data, serviceListing{
+				ID:               svc.ID,
+				RequiredDonation: svc.RequiredDonation,
+				RegisteredAt:     svc.Registered,
+				Domains:          svc.domainStatuses(time.Now()),
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+//DNS providers make the TXT record for a domain's validation challenge and
+//take it away again afterwards, so `register_domain --dns` can go from
+//registration to a validated domain without a trip to the DNS host's panel.
+
+// dnsProvider makes and removes TXT records at the root of a domain.
+type dnsProvider interface {
+	Present(domain string, value string) error
+	CleanUp(domain string, value string) error
+}
+
+// dnsOptions is what the --dns flags say about the provider to use.
+type dnsOptions struct {
+	Provider string
+	// Server, Zone, TSIG* are for rfc2136.
+	Server        string
+	Zone          string
+	TSIGKey       string
+	TSIGAlgorithm string
+	// TSIGSecretFile holds the key's base64 secret, which otherwise comes
+	// from $KYCLI_TSIG_SECRET.
+	TSIGSecretFile string
+	tsigSecret     string
+	// Hook is for hook.
+	Hook string
+}
+
+var dnsProviders = []string{"rfc2136", "hook"}
+
+// newDNSProvider sets up the provider opts asks for.
+func newDNSProvider(opts dnsOptions) (dnsProvider, error) {
+	switch opts.Provider {
+	case "rfc2136":
+		if opts.Server == "" {
+			return nil, errors.New("rfc2136 needs the DNS server to send updates to (--dns-server)")
+		} else if _, _, err := net.SplitHostPort(opts.Server); err != nil {
+			opts.Server = net.JoinHostPort(opts.Server, "53")
+		}
+		if opts.TSIGSecretFile != "" {
+			if b, err := ioutil.ReadFile(opts.TSIGSecretFile); err != nil {
+				return nil, errors.Wrap(err, "error reading TSIG secret")
+			} else {
+				opts.tsigSecret = strings.TrimSpace(string(b))
+			}
+		} else {
+			opts.tsigSecret = os.Getenv("KYCLI_TSIG_SECRET")
+		}
+		if opts.TSIGKey != "" && opts.tsigSecret == "" {
+			return nil, errors.New("a TSIG key needs its secret too (--tsig-secret-file or $KYCLI_TSIG_SECRET)")
+		} else if _, err := base64.StdEncoding.DecodeString(opts.tsigSecret); err != nil {
+			return nil, errors.Wrap(err, "the TSIG secret isn't valid base64")
+		}
+		return rfc2136Provider(opts), nil
+	case "hook":
+		if opts.Hook == "" {
+			return nil, errors.New("hook needs the script to run (--dns-hook)")
+		}
+		return hookProvider(opts.Hook), nil
+	default:
+		return nil, errors.New("unknown DNS provider '" + opts.Provider + "'; pick one of " + strings.Join(dnsProviders, ", "))
+	}
+}
+
+// rfc2136Provider sends dynamic updates, signed with TSIG if given a key.
+type rfc2136Provider dnsOptions
+
+func (p rfc2136Provider) update(domain string, value string, insert bool) error {
+	zone := p.Zone
+	if zone == "" {
+		zone = domain
+	}
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+	c := &dns.Client{Timeout: 10 * time.Second}
+	if p.TSIGKey != "" {
+		alg := dns.Fqdn(strings.ToLower(p.TSIGAlgorithm))
+		m.SetTsig(dns.Fqdn(p.TSIGKey), alg, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{dns.Fqdn(p.TSIGKey): p.tsigSecret}
+	}
+	reply, _, err := c.Exchange(m, p.Server)
+	if err != nil {
+		return errors.Wrap(err, "error sending update to "+p.Server)
+	} else if reply.Rcode != dns.RcodeSuccess {
+		return errors.New(p.Server + " refused the update to " + dns.Fqdn(zone) + ": " + dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+func (p rfc2136Provider) Present(domain string, value string) error {
+	return p.update(domain, value, true)
+}
+
+func (p rfc2136Provider) CleanUp(domain string, value string) error {
+	return p.update(domain, value, false)
+}
+
+// hookProvider runs a script of the user's, like certbot's manual hooks. It's
+// run with "present" or "cleanup" as its argument, and the details in
+// $KYCLI_DNS_ACTION, $KYCLI_DOMAIN and $KYCLI_VALIDATION.
+type hookProvider string
+
+func (p hookProvider) run(action string, domain string, value string) error {
+	cmd := exec.Command(string(p), action)
+	cmd.Env = append(os.Environ(), "KYCLI_DNS_ACTION="+action, "KYCLI_DOMAIN="+domain, "KYCLI_VALIDATION="+value)
+	//Our stdout may be for a structured result.
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return errors.Wrap(cmd.Run(), "error running DNS hook "+string(p)+" "+action)
+}
+
+func (p hookProvider) Present(domain string, value string) error {
+	return p.run("present", domain, value)
+}
+
+func (p hookProvider) CleanUp(domain string, value string) error {
+	return p.run("cleanup", domain, value)
+}
+
+// registerDNSFlags adds the flags for picking and setting up a DNS provider.
+func registerDNSFlags(cmd *cobra.Command, opts *dnsOptions) {
+	cmd.Flags().StringVar(&opts.Provider, "dns", "", "Make the TXT record with this DNS provider ("+strings.Join(dnsProviders, " or ")+") until the domain validates, then remove it")
+	cmd.Flags().StringVar(&opts.Server, "dns-server", "", "For rfc2136, the primary DNS server to send updates to, as host[:port]")
+	cmd.Flags().StringVar(&opts.Zone, "dns-zone", "", "For rfc2136, the zone to update (default the domain itself)")
+	cmd.Flags().StringVar(&opts.TSIGKey, "tsig-key", "", "For rfc2136, the name of the TSIG key to sign updates with")
+	cmd.Flags().StringVar(&opts.TSIGAlgorithm, "tsig-algorithm", "hmac-sha256", "For rfc2136, the TSIG key's algorithm")
+	cmd.Flags().StringVar(&opts.TSIGSecretFile, "tsig-secret-file", "", "For rfc2136, a file with the TSIG key's base64 secret (or set $KYCLI_TSIG_SECRET)")
+	cmd.Flags().StringVar(&opts.Hook, "dns-hook", "", "For hook, the script to run with present or cleanup; it gets $KYCLI_DOMAIN and $KYCLI_VALIDATION")
+	cmd.RegisterFlagCompletionFunc("dns", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return dnsProviders, cobra.ShellCompDirectiveNoFileComp
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//`kycli service domain check` looks for a domain's validation challenges the
+//way the API will, so a typo in a TXT record doesn't cost an hour. Each check
+//ends in a diagnosis saying what's wrong in terms of what to fix.
+
+type domainDiagnosis struct {
+	Method string `json:"method"`
+	Target string `json:"target"`
+	OK     bool   `json:"ok"`
+	// Problem is one of dns, port_closed, connect, redirect, status,
+	// content_mismatch, txt_missing or txt_mismatch.
+	Problem string `json:"problem,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+// domainChecker runs checks, resolving names through Resolver (host:port of a
+// DNS server) if set, and the system's resolver otherwise.
+type domainChecker struct {
+	Resolver string
+	Timeout  time.Duration
+}
+
+func (c domainChecker) resolver() *net.Resolver {
+	if c.Resolver == "" {
+		return net.DefaultResolver
+	}
+	server := c.Resolver
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (c domainChecker) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.Timeout)
+}
+
+// checkPath fetches challenge.Path from domain over scheme (http or https)
+// and compares it with challenge.Content.
+func (c domainChecker) checkPath(scheme string, domain string, challenge domainChallenge) domainDiagnosis {
+	target := scheme + "://" + domain + challenge.Path
+	diag := domainDiagnosis{Method: scheme, Target: target}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	addrs, err := c.resolver().LookupHost(ctx, domain)
+	if err != nil || len(addrs) == 0 {
+		diag.Problem, diag.Detail = "dns", "DNS isn't resolving "+domain+": "+describeDNSError(err)
+		return diag
+	}
+	//Find out whether anything listens before blaming anything else.
+	var dialer net.Dialer
+	if conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addrs[0], port)); err != nil {
+		diag.Problem, diag.Detail = "port_closed", "port "+port+" on "+addrs[0]+" isn't accepting connections: "+err.Error()
+		return diag
+	} else {
+		conn.Close()
+	}
+	client := &http.Client{
+		Timeout: c.Timeout,
+		Transport: &http.Transport{
+			//Connect to the address we resolved, so --resolver applies here too.
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0], port))
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		diag.Problem, diag.Detail = "connect", "couldn't fetch it: "+err.Error()
+		return diag
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		diag.Problem, diag.Detail = "redirect", "it redirects ("+resp.Status+") to "+resp.Header.Get("Location")+"; serve the file at this exact address instead"
+	} else if resp.StatusCode != http.StatusOK {
+		diag.Problem, diag.Detail = "status", "the server answered "+resp.Status
+	} else if err != nil {
+		diag.Problem, diag.Detail = "connect", "couldn't read the response: "+err.Error()
+	} else if got := strings.TrimSpace(string(body)); got != challenge.Content {
+		diag.Problem, diag.Detail = "content_mismatch", "the file doesn't contain the nonce; expected '"+challenge.Content+"' but got '"+truncate(got, 80)+"'"
+	} else {
+		diag.OK, diag.Detail = true, "serves the nonce"
+	}
+	return diag
+}
+
+// checkTXT looks for challenge.Nonce among domain's TXT records.
+func (c domainChecker) checkTXT(domain string, challenge domainChallenge) domainDiagnosis {
+	diag := domainDiagnosis{Method: "txt", Target: domain}
+	ctx, cancel := c.context()
+	defer cancel()
+	records, err := c.resolver().LookupTXT(ctx, domain)
+	var others []string
+	for _, r := range records {
+		if r == challenge.Nonce {
+			diag.OK, diag.Detail = true, "TXT record found"
+			return diag
+		} else if strings.HasPrefix(r, "ufkyc-validation=") {
+			others = append(others, r)
+		}
+	}
+	if len(others) > 0 {
+		diag.Problem, diag.Detail = "txt_mismatch", "there's a UFKYC TXT record, but with another nonce ('"+truncate(others[0], 80)+"'); it should be '"+challenge.Nonce+"'"
+		return diag
+	}
+	diag.Problem = "txt_missing"
+	diag.Detail = "no TXT record at " + domain + " contains '" + challenge.Nonce + "'"
+	if err != nil {
+		diag.Detail += " (" + describeDNSError(err) + ")"
+	}
+	//A common mistake is putting the record on a subdomain.
+	for _, sub := range []string{"www.", "_ufkyc."} {
+		if records, err := c.resolver().LookupTXT(ctx, sub+domain); err == nil {
+			for _, r := range records {
+				if r == challenge.Nonce {
+					diag.Detail += "; it's at " + sub + domain + " instead, but has to be at the root"
+				}
+			}
+		}
+	}
+	return diag
+}
+
+// check runs every check challenge allows for.
+func (c domainChecker) check(domain string, challenge domainChallenge) []domainDiagnosis {
+	var diags []domainDiagnosis
+	if challenge.Path != "" {
+		diags = append(diags, c.checkPath("https", domain, challenge), c.checkPath("http", domain, challenge))
+	}
+	if challenge.Nonce != "" {
+		diags = append(diags, c.checkTXT(domain, challenge))
+	}
+	return diags
+}
+
+func describeDNSError(err error) string {
+	var dnsErr *net.DNSError
+	if err == nil {
+		return "no records"
+	} else if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "no such domain"
+	} else if errors.As(err, &dnsErr) && dnsErr.IsTimeout {
+		return "the DNS server didn't answer"
+	}
+	return err.Error()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -1,15 +1,20 @@
 module unofficialkyc.com/kycli
 
-go 1.14
+go 1.16
 
 require (
 	github.com/asaskevich/govalidator v0.0.0-20200819183940-29e1ff8eb0bb // indirect
 	github.com/atotto/clipboard v0.1.2
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-ozzo/ozzo-validation v3.6.0+incompatible
+	github.com/miekg/dns v1.1.50
+	github.com/mtibben/confusables v0.0.0-20210201002637-9d1b0723b659
 	github.com/pkg/errors v0.9.1
+	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.7.0
+	gopkg.in/yaml.v2 v2.3.0
 	gorm.io/driver/sqlite v1.1.0
 	gorm.io/gorm v1.9.19
 )
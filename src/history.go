@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"unofficialkyc.com/kycli/verify"
+)
+
+//Every token the API gives us is noted down here, minus the token itself: an
+//audit trail of where your passports were used, and the list of sites the
+//lookalike check compares new domains to.
+
+type TokenIssue struct {
+	gorm.Model
+	// Profile is the profile's name rather than its ID, so the history
+	// outlives `profile remove`.
+	Profile   string `gorm:"index"`
+	Username  string
+	Domain    string `gorm:"index"`
+	ExpiresAt time.Time
+}
+
+// recordTokenIssue notes down a token the API just handed us.
+func recordTokenIssue(user *User, domain string, token string) error {
+	issue := TokenIssue{Username: user.Name, Domain: domain}
+	if conf != nil {
+		issue.Profile = conf.Name
+	}
+	//The API signed it, so all we want from it is the expiry; a token we
+	//can't read is still worth remembering.
+	if t, err := verify.Parse(token); err == nil {
+		if claims, err := t.Claims(); err == nil {
+			issue.ExpiresAt = claims.Expiration
+		}
+	}
+	return errors.Wrap(db.Create(&issue).Error, "error saving token history into local db")
+}
+
+type tokenHistoryFilter struct {
+	Domain  string
+	Profile string
+	Since   time.Time
+	Limit   int
+}
+
+func tokenHistory(filter tokenHistoryFilter) ([]TokenIssue, error) {
+	q := db.Order("created_at desc")
+	if filter.Domain != "" {
+		q = q.Where("domain = ?", filter.Domain)
+	}
+	if filter.Profile != "" {
+		q = q.Where("profile = ?", filter.Profile)
+	}
+	if !filter.Since.IsZero() {
+		q = q.Where("created_at >= ?", filter.Since)
+	}
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+	var issues []TokenIssue
+	return issues, errors.Wrap(q.Find(&issues).Error, "error reading token history from local db")
+}
+
+// forgetTokenHistory deletes every record of domain for good, returning how
+// many there were.
+func forgetTokenHistory(domain string) (int64, error) {
+	res := db.Unscoped().Where("domain = ?", domain).Delete(&TokenIssue{})
+	return res.RowsAffected, errors.Wrap(res.Error, "error deleting token history from local db")
+}
+
+// parseSince reads a --since value: a duration back from now, where "d" means
+// days (7d, 12h), or a date (2006-01-02).
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	} else if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	} else if n := len(s); n > 1 && s[n-1] == 'd' {
+		if d, err := time.ParseDuration(s[:n-1] + "h"); err == nil {
+			return time.Now().Add(-24 * d), nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, errors.New("'" + s + "' is neither a duration like 7d or 12h, nor a date like 2006-01-02")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"unofficialkyc.com/kycli/verify"
+)
+
+// fetchPublicKeys grabs the keys the platform currently signs tokens with.
+func fetchPublicKeys(conf *Config) ([]ed25519.PublicKey, error) {
+	w := errWrapper("error fetching platform public keys")
+	if resp, err := http.Get(conf.ApiEndpoint + "/public_key"); err != nil {
+		return nil, w(withExitCode(exitNetwork, err), "error contacting api")
+	} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+		return nil, w(withExitCode(exitNetwork, err), "error reading api response body")
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, w(withExitCode(exitAPI, errors.New(strings.TrimSpace(string(b)))), "api returned a non-200 response code along with the following body")
+	} else if keys, err := verify.ParseKeys(b); err != nil {
+		return nil, w(err)
+	} else {
+		return keys, nil
+	}
+}
+
+func describeTime(t time.Time) string {
+	if t.IsZero() {
+		return "(not set)"
+	}
+	d := time.Until(t).Round(time.Second)
+	if d == 0 {
+		return t.Local().Format(time.RFC1123) + " (just now)"
+	} else if d < 0 {
+		return t.Local().Format(time.RFC1123) + " (" + (-d).String() + " ago)"
+	}
+	return t.Local().Format(time.RFC1123) + " (in " + d.String() + ")"
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/mtibben/confusables"
+	"golang.org/x/net/idna"
+)
+
+//Copying the domain only protects you from phishing if you'd notice the
+//domain being wrong, and nobody notices examp1e.com or an "apple.com" spelled
+//with Cyrillic letters. So before asking for a token we compare the domain to
+//the ones in your token history, and look for scripts mixed inside one label.
+
+// lookalikeScripts are the scripts we tell apart when looking for mixed
+// labels. Letters from anything else count as "other".
+var lookalikeScripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian},
+	{"Cherokee", unicode.Cherokee},
+	{"Han", unicode.Han},
+	{"Hiragana", unicode.Hiragana},
+	{"Katakana", unicode.Katakana},
+	{"Hangul", unicode.Hangul},
+	{"Arabic", unicode.Arabic},
+	{"Hebrew", unicode.Hebrew},
+}
+
+func scriptOf(r rune) string {
+	if unicode.Is(unicode.Common, r) || unicode.Is(unicode.Inherited, r) {
+		return ""
+	}
+	for _, s := range lookalikeScripts {
+		if unicode.Is(s.table, r) {
+			return s.name
+		}
+	}
+	return "other"
+}
+
+// labelScripts lists the scripts used in a label, in order of appearance.
+func labelScripts(label string) []string {
+	var scripts []string
+	seen := map[string]bool{}
+	for _, r := range label {
+		if s := scriptOf(r); s != "" && !seen[s] {
+			seen[s] = true
+			scripts = append(scripts, s)
+		}
+	}
+	return scripts
+}
+
+// skeleton is the UTS #39 skeleton of a domain, casefolded so 0 and o, or
+// 1 and l, end up the same.
+func skeleton(domain string) string {
+	if u, err := idna.ToUnicode(domain); err == nil {
+		domain = u
+	}
+	return strings.ToLower(confusables.Skeleton(strings.ToLower(domain)))
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment) distance
+// between a and b, counting a swap of neighbours as one edit.
+func editDistance(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	d := make([][]int, len(x)+1)
+	for i := range d {
+		d[i] = make([]int, len(y)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && x[i-1] == y[j-2] && x[i-2] == y[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(x)][len(y)]
+}
+
+// lookalikeWarnings explains everything suspicious about domain (a punycode
+// registrable domain), given the domains the user already gets tokens for.
+func lookalikeWarnings(domain string, known []string) []string {
+	var warnings []string
+	for _, k := range known {
+		if k == domain {
+			//You've been here before, so it's whatever you trusted then.
+			return nil
+		}
+	}
+	unicodeDomain, err := idna.ToUnicode(domain)
+	if err != nil {
+		unicodeDomain = domain
+	}
+	for _, label := range strings.Split(unicodeDomain, ".") {
+		if scripts := labelScripts(label); len(scripts) > 1 {
+			warnings = append(warnings, "'"+label+"' mixes "+strings.Join(scripts, " and ")+" letters, which real sites almost never do")
+		} else if len(scripts) == 1 && scripts[0] != "Latin" && skeleton(label) != label && isASCII(skeleton(label)) {
+			warnings = append(warnings, "'"+label+"' is written in "+scripts[0]+" letters that look just like '"+skeleton(label)+"'")
+		}
+	}
+	//Only the names are compared by skeleton and distance; skeletons of whole
+	//domains would have .com and .org two edits apart (.corn).
+	name, suffix := splitRegistrable(domain)
+	s := skeleton(name)
+	for _, k := range known {
+		kname, ksuffix := splitRegistrable(k)
+		ks := skeleton(kname)
+		if ksuffix != suffix {
+			if ks == s {
+				warnings = append(warnings, "it has the same name as "+displayDomain(k)+", which you've used before, under a different suffix")
+			}
+		} else if ks == s {
+			warnings = append(warnings, "it looks the same as "+displayDomain(k)+", which you've used before, but it's a different domain")
+		} else if d := editDistance(ks, s); d == 1 || (d == 2 && len(ks) >= 8) {
+			warnings = append(warnings, fmt.Sprintf("it's only %d character(s) away from %s, which you've used before", d, displayDomain(k)))
+		}
+	}
+	return warnings
+}
+
+// splitRegistrable splits a registrable domain into the label the owner
+// picked and the public suffix it's under.
+func splitRegistrable(domain string) (string, string) {
+	parts := strings.SplitN(domain, ".", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// knownDomains are the domains we've seen the user trust: the ones they run,
+// and the ones anyone on this machine has grabbed tokens for.
+func knownDomains(user *User) []string {
+	var names, issued []string
+	db.Model(&ServiceDomain{}).Where("user_id = ?", user.ID).Distinct().Pluck("name", &names)
+	db.Model(&TokenIssue{}).Distinct().Pluck("domain", &issued)
+	//A domain you run and grabbed tokens for would otherwise warn twice.
+	var known []string
+	seen := map[string]bool{}
+	for _, d := range append(names, issued...) {
+		if !seen[d] {
+			seen[d] = true
+			known = append(known, d)
+		}
+	}
+	return known
+}
+
+// allowLookalike skips the extra confirmation, for scripts that already know.
+var allowLookalike bool
+
+// confirmLookalike makes a lot of noise about warnings and only carries on if
+// the user types the domain out. --yes doesn't answer this; --allow-lookalike
+// does.
+func confirmLookalike(domain string, warnings []string) (bool, error) {
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "!!! WARNING: "+displayDomain(domain)+" looks like it could be impersonating another site !!!")
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "  -", w)
+	}
+	fmt.Fprintln(os.Stderr, "If you didn't expect this, close the page: you're probably being phished.")
+	fmt.Fprintln(os.Stderr, "")
+	if allowLookalike {
+		fmt.Fprintln(os.Stderr, "Carrying on anyway (--allow-lookalike).")
+		return true, nil
+	}
+	typed, err := promptLine("Type "+domain+" to grab a token for it anyway: ", "lookalike confirmation", "--allow-lookalike")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSuffix(strings.ToLower(typed), ".") == domain, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "abc", 0},
+		{"", "abc", 3},
+		{"example", "exampel", 1},
+		{"example", "examples", 1},
+		{"example", "exmple", 1},
+		{"example", "exbmple", 1},
+		{"kitten", "sitting", 3},
+		{"ca", "abc", 3},
+		{"bücher", "bucher", 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		} else if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"example", "Example", true},
+		{"examp1e", "example", true},
+		{"paypa1", "paypal", true},
+		{"g00gle", "google", true},
+		{"modern", "rnodern", true},
+		//ѕсоре in Cyrillic.
+		{"xn--e1argc3h", "scope", true},
+		{"ѕсоре", "scope", true},
+		//UTS #39 has the palochka in аррӏе looking like i, not l.
+		{"xn--80ak6aa92e", "appie", true},
+		{"xn--80ak6aa92e", "apple", false},
+		{"example", "exampel", false},
+		{"github", "gitlab", false},
+	}
+	for _, tt := range tests {
+		if got := skeleton(tt.a) == skeleton(tt.b); got != tt.same {
+			t.Errorf("skeleton(%q) = %q and skeleton(%q) = %q, want same = %v", tt.a, skeleton(tt.a), tt.b, skeleton(tt.b), tt.same)
+		}
+	}
+}
+
+func TestLookalikeWarnings(t *testing.T) {
+	known := []string{"example.com", "github.com", "bar.github.io", "paypal.com", "apple.com", "scope.com", "xn--bcher-kva.de"}
+	tests := []struct {
+		domain string
+		want   []string
+	}{
+		{"example.com", nil},
+		{"xn--bcher-kva.de", nil},
+		{"foo.github.io", nil},
+		{"gitlab.com", nil},
+		{"unrelated.org", nil},
+		{"example.org", []string{"it has the same name as example.com, which you've used before, under a different suffix"}},
+		{"paypa1.com", []string{"it looks the same as paypal.com, which you've used before, but it's a different domain"}},
+		{"exampel.com", []string{"it's only 1 character(s) away from example.com, which you've used before"}},
+		{"githbu.com", []string{"it's only 1 character(s) away from github.com, which you've used before"}},
+		{"baz.github.io", []string{"it's only 1 character(s) away from bar.github.io, which you've used before"}},
+		{"xn--e1argc3h.com", []string{
+			"'ѕсоре' is written in Cyrillic letters that look just like 'scope'",
+			"it looks the same as scope.com, which you've used before, but it's a different domain",
+		}},
+		{"xn--80ak6aa92e.com", []string{
+			"'аррӏе' is written in Cyrillic letters that look just like 'appie'",
+			"it's only 1 character(s) away from apple.com, which you've used before",
+		}},
+		{"xn--pple-43d.net", []string{
+			"'аpple' mixes Cyrillic and Latin letters, which real sites almost never do",
+			"it has the same name as apple.com, which you've used before, under a different suffix",
+		}},
+	}
+	for _, tt := range tests {
+		if got := lookalikeWarnings(tt.domain, known); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookalikeWarnings(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -15,16 +16,19 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/atotto/clipboard"
 	"github.com/davecgh/go-spew/spew"
 	validation "github.com/go-ozzo/ozzo-validation"
 	"github.com/go-ozzo/ozzo-validation/is"
 	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
 
 	"golang.org/x/crypto/ssh/terminal"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"unofficialkyc.com/kycli/verify"
 )
 
 var isInsideSnap = os.Getenv("SNAP") != ""
@@ -75,39 +79,87 @@ var db *gorm.DB
 func withDB(f func(*gorm.DB), e func(err error)) {
 	if db == nil {
 		w := errWrapper("error initializing local db")
+		var openErr error
 		withDBPath(func(path string) {
-			var err error
-			if db, err = gorm.Open(sqlite.Open(path), &gorm.Config{}); err != nil {
-				e(w(err, "error opening local db"))
-			} else if err = db.AutoMigrate(&User{}); err != nil {
-				e(w(err, "error migrating user table for local db"))
-			} else if err = db.AutoMigrate(&Config{}); err != nil {
-				e(w(err, "error migrating config table for local db"))
+			if db, openErr = gorm.Open(sqlite.Open(path), &gorm.Config{}); openErr != nil {
+				openErr = w(openErr, "error opening local db")
+			} else if err := db.AutoMigrate(&User{}); err != nil {
+				openErr = w(err, "error migrating user table for local db")
+			} else if err := db.AutoMigrate(&Config{}); err != nil {
+				openErr = w(err, "error migrating config table for local db")
+			} else if err := db.AutoMigrate(&Service{}, &ServiceDomain{}); err != nil {
+				openErr = w(err, "error migrating service tables for local db")
+			} else if err := db.AutoMigrate(&TokenIssue{}); err != nil {
+				openErr = w(err, "error migrating token history table for local db")
 			}
 		}, func(err error) {
-			e(w(err))
+			openErr = w(err)
 		})
+		if openErr != nil {
+			db = nil
+			e(withExitCode(exitStorage, openErr))
+			return
+		}
 	}
 	f(db)
 }
 
 type User struct {
 	gorm.Model
-	Name     string
-	ApiToken string `gorm:"column:api_token"`
+	Name string
+	// ApiToken is loaded from the profile's credential store by withUser.
+	ApiToken string `gorm:"-"`
+	// StoredToken is only used by the sqlite credential store.
+	StoredToken string `gorm:"column:api_token"`
+	// agentSock is set when a kycli agent holds the token instead of us.
+	agentSock string
 }
 
+// PostForm posts vals to the API with the user's token. If the API says the
+// token is no good (expired or revoked), the user is logged in again and the
+// request is sent one more time. That's safe even for /donate, because a 401
+// is returned before the API acts on anything; we never resend after a
+// network error or any other status.
 func (u *User) PostForm(uri string, vals url.Values) (*http.Response, error) {
+	return u.postForm(uri, vals, true)
+}
+
+// PostFormOnce is PostForm without logging in again on a 401.
+func (u *User) PostFormOnce(uri string, vals url.Values) (*http.Response, error) {
+	return u.postForm(uri, vals, false)
+}
+
+func (u *User) postForm(uri string, vals url.Values, reauth bool) (*http.Response, error) {
 	var ret *http.Response
 	var retErr error
 	withConfig(
 		func(conf *Config) {
-			if req, err := http.NewRequest("POST", conf.ApiEndpoint+uri, bytes.NewBuffer([]byte(vals.Encode()))); err != nil {
-				retErr = err
-			} else {
-				req.Header.Set("Authorization", u.ApiToken)
-				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-				ret, retErr = http.DefaultClient.Do(req)
+			if u.agentSock != "" {
+				//The agent can't ask for a password, so there's no logging in
+				//again either.
+				ret, retErr = agentPost(u, conf.Name, uri, vals)
+				return
+			}
+			post := func() (*http.Response, error) {
+				if req, err := http.NewRequest("POST", conf.ApiEndpoint+uri, bytes.NewBuffer([]byte(vals.Encode()))); err != nil {
+					return nil, err
+				} else {
+					req.Header.Set("Authorization", u.ApiToken)
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					resp, err := http.DefaultClient.Do(req)
+					return resp, withExitCode(exitNetwork, err)
+				}
+			}
+			if ret, retErr = post(); retErr == nil && reauth && u.ID != 0 && ret.StatusCode == http.StatusUnauthorized {
+				ret.Body.Close()
+				fmt.Println("The API rejected your API token for '" + u.Name + "'; it has probably expired or been revoked. Please log in again.")
+				//login only replaces the stored token once it has a new one.
+				if err := login(conf); err != nil {
+					ret, retErr = nil, err
+				} else {
+					u.ApiToken = conf.User.ApiToken
+					ret, retErr = post()
+				}
 			}
 		},
 		func(err error) {
@@ -117,43 +169,84 @@ func (u *User) PostForm(uri string, vals url.Values) (*http.Response, error) {
 	return ret, retErr
 }
 
+// grabToken asks the API for a token for domain, and notes it down in the
+// token history.
+func grabToken(user *User, domain string) (string, error) {
+	if resp, err := user.PostForm("/get_account_token", url.Values{
+		"service_domain": []string{domain},
+	}); err != nil {
+		return "", withExitCode(exitNetwork, errors.Wrap(err, "error contacting api for new token"))
+	} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+		return "", withExitCode(exitNetwork, errors.Wrap(err, "error reading response body of api request"))
+	} else if rstr := strings.TrimSpace(string(b)); resp.StatusCode != http.StatusOK {
+		return "", withExitCode(apiFailure(resp.StatusCode), errors.New("the API rejected the request and responded with the following: "+rstr))
+	} else {
+		warnUnrecorded(recordTokenIssue(user, domain, rstr))
+		return rstr, nil
+	}
+}
+
+// login asks for the passport's credentials and trades them for a new API
+// token, which becomes the profile's user.
+func login(conf *Config) error {
+	w := errWrapper("error logging in")
+	if username, err := promptUsername(); err != nil {
+		return w(err)
+	} else if password, err := promptPassword(false); err != nil {
+		return w(err)
+	} else if resp, err := http.PostForm(conf.ApiEndpoint+"/new_api_token", url.Values{
+		"username": []string{username},
+		"password": []string{password},
+	}); err != nil {
+		return w(withExitCode(exitNetwork, err), "error requesting refresh token from api")
+	} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+		return w(withExitCode(exitNetwork, err), "error reading api login response body")
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return withExitCode(exitAuth, errors.New("Incorrect username or password"))
+	} else if resp.StatusCode != 200 {
+		return w(withExitCode(exitAPI, errors.New(string(b))), "api returned non-200 response code when trying to get a new API token, along with the following body")
+	} else if token := strings.TrimSpace(string(b)); !validAPIToken(token) {
+		return w(withExitCode(exitAPI, errors.New(string(b))), "the api returned a success status code, but the following, structurally invalid api token")
+	} else {
+		return saveLogin(conf, username, token)
+	}
+}
+
 func withUser(f func(user *User), e func(err error)) {
 	w := errWrapper("error grabbing logged in user from db")
 	withConfig(func(conf *Config) {
-		if conf.User.Name == "" {
+		if token := os.Getenv("KYCLI_TOKEN"); token != "" {
+			//Used as is and never stored; the ID of 0 keeps postForm from
+			//trying to replace it.
+			f(&User{Name: os.Getenv("KYCLI_USERNAME"), ApiToken: token})
+			return
+		} else if user := agentUser(conf); user != nil && conf.User.ApiToken == "" {
+			f(user)
+			return
+		} else if conf.User.Name == "" {
 			fmt.Println("Haven't authenticated yet; please log in.")
-			fmt.Print("Username: ")
-			var username string
-			fmt.Scanln(&username)
-			fmt.Print("Password: ")
-			if password, err := secureTermRead(); err != nil {
-				e(w(err, "error reading password from terminal"))
-			} else if resp, err := http.PostForm(conf.ApiEndpoint+"/new_api_token", url.Values{
-				"username": []string{username},
-				"password": []string{password},
-			}); err != nil {
-				e(w(err, "error requesting refresh token from api"))
-			} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
-				e(w(err, "error reading api login response body"))
-			} else if resp.StatusCode == http.StatusUnauthorized {
-				e(errors.New("Incorrect username or password"))
-			} else if resp.StatusCode != 200 {
-				e(w(errors.New(string(b)), "api returned non-200 response code when trying to get a new API token, along with the following body"))
-			} else if token := string(b); !validAPIToken(token) {
-				e(w(errors.New(string(b)), "the api returned a success status code, but the following, structurally invalid api token"))
-			} else {
-				conf.User.Name = username
-				conf.User.ApiToken = strings.TrimSpace(string(b))
-				if err := db.Save(&conf.User).Error; err != nil {
-					e(w(err, "error saving user into configuration"))
-				} else {
-					conf.UserID = conf.User.ID
-					if err := db.Save(&conf).Error; err != nil {
-						e(w(err, "error saving user into configuration"))
-					}
+			if err := login(conf); err != nil {
+				e(w(err))
+				return
+			}
+		} else if conf.User.ApiToken == "" {
+			if store, err := credentialStoreFor(conf); err != nil {
+				e(w(withExitCode(exitStorage, err)))
+				return
+			} else if token, err := store.Get(&conf.User); err != nil {
+				e(w(withExitCode(exitStorage, err), "error loading api token from the credential store"))
+				return
+			} else if token == "" {
+				fmt.Println("Your API token for '" + conf.User.Name + "' is missing from the credential store; please log in again.")
+				if err := login(conf); err != nil {
+					e(w(err))
+					return
 				}
+			} else {
+				conf.User.ApiToken = token
 			}
 		}
+		offerToAgent(conf, &conf.User)
 		f(&conf.User)
 	}, func(err error) {
 		e(w(err))
@@ -162,9 +255,17 @@ func withUser(f func(user *User), e func(err error)) {
 
 type Config struct {
 	gorm.Model
+	Name        string
+	Current     bool
 	ApiEndpoint string `gorm:"column:api_endpoint"`
-	UserID      uint
-	User        User
+	// CredentialBackend is one of credentialBackends; empty means sqlite.
+	CredentialBackend string
+	CredentialCommand string
+	UserID            uint
+	User              User
+	// DefaultService is the ID of the service service commands act on when
+	// not given --service.
+	DefaultService string
 }
 
 var conf *Config
@@ -172,28 +273,27 @@ var conf *Config
 func withConfig(f func(*Config), e func(err error)) {
 	if conf == nil {
 		w := errWrapper("error getting config from db")
-		withDB(
-			func(db *gorm.DB) {
-				var configs []Config
-				if err := db.Preload("User").Find(&configs).Error; err != nil {
-					e(w(err))
-				} else if len(configs) == 0 {
+		var selErr error
+		withProfiles(
+			func(profiles []Config) {
+				if conf, selErr = selectProfile(profiles); selErr == nil && conf == nil {
 					conf = &Config{
-						ApiEndpoint: "https://unofficialkyc.com/api/v1",
-					}
-					if err := db.Save(conf).Error; err != nil {
-						e(w(err))
+						Name:        defaultProfileName,
+						Current:     len(profiles) == 0,
+						ApiEndpoint: defaultApiEndpoint,
 					}
-				} else if len(configs) == 1 {
-					conf = &configs[0]
-				} else {
-					e(w(errors.New("You have multiple configs in your db. You should probably delete it. It's in local/share/unofficialkyc")))
+					selErr = db.Save(conf).Error
 				}
 			},
 			func(err error) {
-				e(w(err))
+				selErr = err
 			},
 		)
+		if selErr != nil {
+			conf = nil
+			e(w(selErr))
+			return
+		}
 	}
 	f(conf)
 }
@@ -207,22 +307,9 @@ func secureTermRead() (string, error) {
 	}
 }
 
-func printHelp() {
-	fmt.Println(`
-    List of commands:
-    whoami - Prints some user information.
-    register - Registers a new UFKYC passport.
-    token - Grab a UFKYC token for the domain in your clipboard.
-    donate (fiat|crypto) [amount] - Donate to add to your credibility score (and buy some Kenyan kid a malaria net).
-    service register - Registers a UFKYC service users will be able to generate.
-    service register_domain [name] - Adds an unvalidated domain to your UFKYC service, and starts the validation process.
-    service require_donation [amount] - (Optional) Adds an amount users have to have donated in order to create tokens for your service.
-    `)
-}
-
 func dangerous(f func()) {
 	if os.Getenv("DANGEROUS") != "TRUE" {
-		fmt.Println("You don't have the DANGEROUS=TRUE environment variable set. This command requires it; please don't use api_switch unless you are either a UFKYC developer or want to get owned.")
+		fail(exitEnvironment, "You don't have the DANGEROUS=TRUE environment variable set. This command requires it; please don't use api_switch unless you are either a UFKYC developer or want to get owned.")
 	} else {
 		f()
 	}
@@ -234,104 +321,511 @@ func dangerous(f func()) {
 //cleaner.  If you have a refactoring suggestion make sure it's not that _real_
 //dumb one.
 
+// confirmTokenDomain spells out exactly which domain a token is for before we
+// ask for it. The token works on every site under that domain, so if the
+// address you copied isn't the site you thought you were on, this is where
+// you find out.
+func confirmTokenDomain(user *User, input string, host string, domain string) (bool, error) {
+	if strings.TrimSuffix(strings.ToLower(strings.TrimSpace(input)), ".") != domain {
+		fmt.Println("You gave:       ", strings.TrimSpace(input))
+		if host != domain {
+			fmt.Println("Site:           ", displayDomain(host))
+		}
+		fmt.Println("Token is for:   ", displayDomain(domain))
+		fmt.Println("Check that's the site you meant to sign in to; it's the part that matters.")
+	}
+	if warnings := lookalikeWarnings(domain, knownDomains(user)); len(warnings) > 0 {
+		if ok, err := confirmLookalike(domain, warnings); err != nil || !ok {
+			return false, err
+		}
+	}
+	return confirm("Grab token for " + displayDomain(domain))
+}
+
+// requireSubcommand is the Run of commands that only group others.
+func requireSubcommand(cmd *cobra.Command, args []string) {
+	fail(exitUsage, cmd.CommandPath()+" needs a subcommand.")
+	cmd.Usage()
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Must specify a command.")
-		printHelp()
-	} else {
-		command := os.Args[1]
-		switch command {
-		case "whoami":
+	root := &cobra.Command{
+		Use:   "kycli",
+		Short: "The UnofficialKYC command line interface",
+		Long: `kycli creates UFKYC passports, tokens and services.
+
+Besides the flags below, these environment variables are read:
+  KYCLI_PROFILE      Profile to act on, like --profile.
+  KYCLI_USERNAME     Username to log in or register with, like --username.
+  KYCLI_PASSWORD_FILE  File to read the password from, like --password-file.
+  KYCLI_TOKEN        Use this API token instead of the profile's passport, without storing it.
+  KYCLI_PASSPHRASE   Passphrase for the encrypted credential store.
+  KYCLI_AGENT_SOCK   Socket of a running ` + "`kycli agent`" + ` to make API requests through.
+  KYCLI_TSIG_SECRET  TSIG secret for ` + "`register_domain --dns rfc2136`" + `, like --tsig-secret-file.
+
+Exit codes: 0 success, 1 other failure, 2 usage, 3 auth, 4 network,
+5 API rejection, 6 local storage, 7 clipboard/environment.`,
+		Args:          cobra.NoArgs,
+		Run:           requireSubcommand,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return setupOutput()
+		},
+	}
+	flags := root.PersistentFlags()
+	flags.StringVar(&profileFlag, "profile", "", "Act on a profile other than the current one (or set $KYCLI_PROFILE)")
+	flags.BoolVar(&nonInteractive, "non-interactive", false, "Never prompt; fail if something we'd ask for wasn't provided")
+	flags.BoolVarP(&assumeYes, "yes", "y", false, "Answer yes to confirmations")
+	flags.StringVar(&usernameFlag, "username", "", "Username to log in or register with (or set $KYCLI_USERNAME)")
+	flags.StringVar(&passwordFileFlag, "password-file", "", "Read the password from a file (or set $KYCLI_PASSWORD_FILE)")
+	flags.BoolVar(&passwordStdin, "password-stdin", false, "Read the password from the first line of stdin")
+	flags.StringVarP(&outputFormat, "output", "o", "text", "Print one structured result object (json or yaml) on stdout instead of prose; messages go to stderr")
+	root.RegisterFlagCompletionFunc("profile", completeProfiles)
+	root.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"text", "json", "yaml"}, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	whoamiCmd := &cobra.Command{
+		Use:   "whoami",
+		Short: "Prints some user information",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
 			withConfig(func(conf *Config) {
 				if conf.User.Name == "" {
-					fmt.Println("You're not logged in yet.")
+					fmt.Println("You're not logged in yet (profile '" + conf.Name + "').")
 				} else {
-					fmt.Println("You're logged in as user '" + conf.User.Name + "'")
+					fmt.Println("You're logged in as user '" + conf.User.Name + "' (profile '" + conf.Name + "')")
 				}
+				emit(map[string]interface{}{
+					"profile":   conf.Name,
+					"logged_in": conf.User.Name != "",
+					"username":  conf.User.Name,
+					"endpoint":  conf.ApiEndpoint,
+				})
 			}, func(err error) {
-				fmt.Println("Couldn't grab user from db:", err)
+				fail(exitStorage, "Couldn't grab user from db:", err)
 			})
-		case "api_switch":
+		},
+	}
+	apiSwitchCmd := &cobra.Command{
+		Use:   "api_switch [api endpoint]",
+		Short: "Points the current profile at another API (needs DANGEROUS=TRUE)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
 			dangerous(func() {
-				if len(os.Args) == 3 {
-					if !strings.HasPrefix(os.Args[2], "http") || validation.Validate(os.Args[2], is.URL) != nil {
-						fmt.Println("Passed argument is not a valid URL.")
-					} else {
-						withConfig(func(config *Config) {
-							config.ApiEndpoint = os.Args[2]
-							if err := db.Save(config).Error; err != nil {
-								fmt.Println("Error saving new API endpoint into database:", err)
-							} else {
-								fmt.Println("All your commands will now contact", os.Args[2], "for api requests.")
+				if !strings.HasPrefix(args[0], "http") || validation.Validate(args[0], is.URL) != nil {
+					fail(exitUsage, "Passed argument is not a valid URL.")
+				} else {
+					withConfig(func(config *Config) {
+						config.ApiEndpoint = args[0]
+						if err := db.Save(config).Error; err != nil {
+							fail(exitStorage, "Error saving new API endpoint into database:", err)
+						} else {
+							fmt.Println("All your commands will now contact", args[0], "for api requests.")
+							emit(map[string]interface{}{"ok": true, "profile": config.Name, "endpoint": args[0]})
+						}
+					}, func(err error) {
+						fail(exitStorage, "Couldn't switch apis:", err)
+					})
+				}
+			})
+		},
+	}
+	profileCmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Manages profiles, each with its own passport and API endpoint",
+		Args:  cobra.NoArgs,
+		Run:   requireSubcommand,
+	}
+	profileListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Lists your profiles, marking the current one",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withProfiles(func(profiles []Config) {
+				type entry struct {
+					Name     string `json:"name"`
+					Endpoint string `json:"endpoint"`
+					Username string `json:"username"`
+					Current  bool   `json:"current"`
+				}
+				entries := []entry{}
+				current, _ := selectProfile(profiles)
+				if len(profiles) == 0 {
+					fmt.Println("You don't have any profiles yet; the first command you run will create '" + defaultProfileName + "'.")
+				}
+				for i, p := range profiles {
+					isCurrent := current != nil && current.ID == p.ID
+					marker := "  "
+					if isCurrent {
+						marker = "* "
+					}
+					user := "not logged in"
+					if p.User.Name != "" {
+						user = "logged in as '" + p.User.Name + "'"
+					}
+					fmt.Println(marker+profiles[i].Name+" - "+p.ApiEndpoint+",", user)
+					entries = append(entries, entry{p.Name, p.ApiEndpoint, p.User.Name, isCurrent})
+				}
+				emit(entries)
+			}, func(err error) {
+				fail(exitStorage, "Couldn't list profiles:", err)
+			})
+		},
+	}
+	profileAddCmd := &cobra.Command{
+		Use:   "add [name] [api endpoint]",
+		Short: "Adds a profile with its own passport and API endpoint",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if name := args[0]; !validProfileName.MatchString(name) {
+				fail(exitUsage, "Profile names can only contain letters, numbers, dashes and underscores.")
+			} else {
+				add := func(endpoint string) {
+					withProfiles(func(profiles []Config) {
+						if findProfile(profiles, name) != nil {
+							fail(exitUsage, "A profile named '"+name+"' already exists.")
+						} else if err := db.Save(&Config{Name: name, ApiEndpoint: endpoint}).Error; err != nil {
+							fail(exitStorage, "Error saving new profile into database:", err)
+						} else {
+							fmt.Println("Added profile '" + name + "'. Switch to it with `kycli profile use " + name + "`, or pass --profile " + name + ".")
+							emit(map[string]interface{}{"ok": true, "profile": name, "endpoint": endpoint})
+						}
+					}, func(err error) {
+						fail(exitStorage, "Couldn't add profile:", err)
+					})
+				}
+				if len(args) == 1 {
+					add(defaultApiEndpoint)
+				} else if !strings.HasPrefix(args[1], "http") || validation.Validate(args[1], is.URL) != nil {
+					fail(exitUsage, "Passed API endpoint is not a valid URL.")
+				} else if args[1] == defaultApiEndpoint {
+					add(args[1])
+				} else {
+					dangerous(func() {
+						add(args[1])
+					})
+				}
+			}
+		},
+	}
+	profileUseCmd := &cobra.Command{
+		Use:               "use [name]",
+		Short:             "Makes a profile the current one",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: onlyFirstArg(completeProfiles),
+		Run: func(cmd *cobra.Command, args []string) {
+			withProfiles(func(profiles []Config) {
+				if p := findProfile(profiles, args[0]); p == nil {
+					fail(exitUsage, "There's no profile named '"+args[0]+"'.")
+				} else if err := db.Model(&Config{}).Where("current = ?", true).Update("current", false).Error; err != nil {
+					fail(exitStorage, "Error switching profiles:", err)
+				} else if err := db.Model(p).Update("current", true).Error; err != nil {
+					fail(exitStorage, "Error switching profiles:", err)
+				} else {
+					fmt.Println("Now using profile '" + p.Name + "'.")
+					emit(map[string]interface{}{"ok": true, "profile": p.Name})
+				}
+			}, func(err error) {
+				fail(exitStorage, "Couldn't switch profiles:", err)
+			})
+		},
+	}
+	profileRemoveCmd := &cobra.Command{
+		Use:               "remove [name]",
+		Short:             "Removes a profile and forgets its passport",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: onlyFirstArg(completeProfiles),
+		Run: func(cmd *cobra.Command, args []string) {
+			withProfiles(func(profiles []Config) {
+				current, _ := selectProfile(profiles)
+				if p := findProfile(profiles, args[0]); p == nil {
+					fail(exitUsage, "There's no profile named '"+args[0]+"'.")
+				} else if current != nil && current.ID == p.ID {
+					fail(exitUsage, "You can't remove the profile you're using; switch to another one with `kycli profile use` first.")
+				} else {
+					question := "Remove profile '" + p.Name + "'"
+					if p.User.Name != "" {
+						question += " and forget its passport '" + p.User.Name + "'"
+					}
+					if ok, err := confirm(question); err != nil {
+						fail(exitUsage, "Couldn't remove profile:", err)
+					} else if ok {
+						if p.UserID != 0 {
+							if err := forgetLogin(p); err != nil {
+								fail(exitStorage, "Error removing the profile's passport:", err)
+								return
 							}
-						}, func(err error) {
-							fmt.Println("Couldn't switch apis:", err)
-						})
+						}
+						if err := db.Unscoped().Delete(p).Error; err != nil {
+							fail(exitStorage, "Error removing profile:", err)
+						} else {
+							fmt.Println("Removed profile '" + p.Name + "'.")
+							emit(map[string]interface{}{"ok": true, "profile": p.Name})
+						}
 					}
 				}
+			}, func(err error) {
+				fail(exitStorage, "Couldn't remove profile:", err)
 			})
-		case "register":
-			//We need the config so we can save the user and also so that we can know what endpoint to contact
+		},
+	}
+	profileCmd.AddCommand(profileListCmd, profileAddCmd, profileUseCmd, profileRemoveCmd)
+	credentialsShowCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Shows where the current profile keeps its API token",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
 			withConfig(func(conf *Config) {
-				if conf.User.Name != "" {
-					fmt.Println("You have already logged in as user '" + conf.User.Name + "'.")
+				backend := conf.CredentialBackend
+				if backend == "" {
+					backend = "sqlite"
+				}
+				fmt.Println("Profile '" + conf.Name + "' keeps its API token in the '" + backend + "' credential store.")
+				if backend == "exec" {
+					fmt.Println("Credential helper command:", describeCredentialArgv(credentialArgv(conf.CredentialCommand)))
+				}
+				emit(map[string]interface{}{"profile": conf.Name, "backend": backend, "command": credentialArgv(conf.CredentialCommand)})
+			}, func(err error) {
+				fail(exitStorage, "Couldn't grab profile:", err)
+			})
+		},
+	}
+	credentialsCmd := &cobra.Command{
+		Use:   "credentials",
+		Short: "Shows or changes where the current profile keeps its API token",
+		Args:  cobra.NoArgs,
+		Run:   credentialsShowCmd.Run,
+	}
+	credentialsMigrateCmd := &cobra.Command{
+		Use:   "migrate (sqlite|file|exec) [helper command...]",
+		Short: "Moves the API token into another credential store",
+		Args:  cobra.MinimumNArgs(1),
+		Long: `Moves the API token into another credential store. file encrypts it with a
+passphrase ($KYCLI_PASSPHRASE or a prompt); exec hands it to a git-credential
+style helper, run as the given command with get, store or erase appended.
+Everything after the backend is the helper's, flags included:
+
+  kycli credentials migrate exec sh -c 'pass-helper "$@"' helper`,
+		ValidArgs: credentialBackends,
+		Run: func(cmd *cobra.Command, args []string) {
+			withConfig(func(conf *Config) {
+				target := *conf
+				target.CredentialBackend = args[0]
+				target.CredentialCommand = encodeCredentialArgv(args[1:])
+				switchBackend := func() error {
+					return db.Model(conf).Updates(map[string]interface{}{
+						"credential_backend": target.CredentialBackend,
+						"credential_command": target.CredentialCommand,
+					}).Error
+				}
+				backendOf := func(c *Config) string {
+					if c.CredentialBackend == "" {
+						return "sqlite"
+					}
+					return c.CredentialBackend
+				}
+				if args[0] != "exec" && target.CredentialCommand != "" {
+					fail(exitUsage, "Only the exec backend takes a helper command.")
+				} else if backendOf(conf) == backendOf(&target) && encodeCredentialArgv(credentialArgv(conf.CredentialCommand)) == target.CredentialCommand {
+					fail(exitUsage, "Profile '"+conf.Name+"' already keeps its API token in that credential store.")
+				} else if from, err := credentialStoreFor(conf); err != nil {
+					fail(exitStorage, "Couldn't open the current credential store:", err)
+				} else if to, err := credentialStoreFor(&target); err != nil {
+					fail(exitStorage, "Couldn't open the new credential store:", err)
+				} else if conf.User.Name == "" {
+					if err := switchBackend(); err != nil {
+						fail(exitStorage, "Error saving the new credential backend:", err)
+					} else {
+						fmt.Println("You're not logged in, so there was nothing to move; profile '" + conf.Name + "' will use the '" + args[0] + "' credential store from now on.")
+						emit(map[string]interface{}{"ok": true, "profile": conf.Name, "backend": args[0], "moved": false})
+					}
+				} else if token, err := from.Get(&conf.User); err != nil {
+					fail(exitStorage, "Couldn't read your API token from the current credential store:", err)
+				} else if err := to.Set(&conf.User, token); err != nil {
+					fail(exitStorage, "Couldn't write your API token into the new credential store:", err)
+				} else if err := switchBackend(); err != nil {
+					fail(exitStorage, "Error saving the new credential backend (your token is in both stores now):", err)
+				} else if err := from.Delete(&conf.User); err != nil {
+					fail(exitStorage, "Moved your API token, but couldn't remove it from the old credential store:", err)
 				} else {
-					fmt.Print("Username: ")
-					var username string
-					fmt.Scanln(&username)
-					password := ""
-					for {
-						var err error
-						fmt.Print("Password: ")
-						if password, err = secureTermRead(); err != nil {
-							fmt.Println("Couldn't read password from terminal; " + err.Error())
+					fmt.Println("Moved the API token for '" + conf.User.Name + "' into the '" + args[0] + "' credential store.")
+					emit(map[string]interface{}{"ok": true, "profile": conf.Name, "backend": args[0], "moved": true})
+				}
+			}, func(err error) {
+				fail(exitStorage, "Couldn't grab profile:", err)
+			})
+		},
+	}
+	//The helper's own flags aren't ours.
+	credentialsMigrateCmd.Flags().SetInterspersed(false)
+	credentialsCmd.AddCommand(credentialsShowCmd, credentialsMigrateCmd)
+	logoutCmd := &cobra.Command{
+		Use:   "logout",
+		Short: "Revokes this machine's API token and forgets the passport",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withConfig(func(conf *Config) {
+				local, _ := cmd.Flags().GetBool("local")
+				name := conf.User.Name
+				if name == "" {
+					fail(exitAuth, "You're not logged in.")
+				} else if local {
+					if err := forgetLogin(conf); err != nil {
+						fail(exitStorage, "Couldn't forget your passport:", err)
+					} else {
+						fmt.Println("Forgot your passport locally. Its API token was NOT revoked; revoke it from another machine with `kycli sessions revoke`.")
+						emit(map[string]interface{}{"ok": true, "profile": conf.Name, "username": name, "revoked": false})
+					}
+				} else {
+					withUser(func(user *User) {
+						if resp, err := user.PostFormOnce("/revoke_api_token", url.Values{}); err != nil {
+							fail(exitNetwork, "Error contacting API to revoke your token (you're still logged in):", err)
+							fmt.Fprintln(os.Stderr, "Use `kycli logout --local` to forget your passport on this machine anyway.")
+						} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+							fail(exitNetwork, "Error reading API response (you're still logged in):", err)
+						} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+							fail(apiFailure(resp.StatusCode), "The API refused to revoke your token (you're still logged in) and responded with the following:", strings.TrimSpace(string(b)))
+							fmt.Fprintln(os.Stderr, "Use `kycli logout --local` to forget your passport on this machine anyway.")
+						} else if err := forgetLogin(conf); err != nil {
+							fail(exitStorage, "Revoked your API token, but couldn't forget it locally:", err)
 						} else {
-							fmt.Print("Confirm password: ")
-							if passwordConfirmation, err := secureTermRead(); err != nil {
-								fmt.Println("Couldn't read password from terminal; " + err.Error())
-							} else if password != passwordConfirmation {
-								fmt.Println("Passwords were not the same, try again: ")
-							} else {
-								break
-							}
+							fmt.Println("Logged out of '" + name + "' and revoked this machine's API token.")
+							emit(map[string]interface{}{"ok": true, "profile": conf.Name, "username": name, "revoked": true})
+						}
+					}, func(err error) {
+						fail(exitAuth, "Couldn't grab credentials to log out with:", err)
+					})
+				}
+			}, func(err error) {
+				fail(exitStorage, "Couldn't grab profile:", err)
+			})
+		},
+	}
+	logoutCmd.Flags().Bool("local", false, "Only forget the passport locally, without revoking its API token")
+	sessionsCmd := &cobra.Command{
+		Use:   "sessions",
+		Short: "Manages the API tokens issued to your passport",
+		Args:  cobra.NoArgs,
+		Run:   requireSubcommand,
+	}
+	sessionsListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the API tokens issued to your passport on every machine",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withUser(func(user *User) {
+				type session struct {
+					ID         string    `json:"id"`
+					CreatedAt  time.Time `json:"created_at"`
+					LastUsedAt time.Time `json:"last_used_at"`
+					Current    bool      `json:"current"`
+				}
+				var sessions struct {
+					Data []session `json:"data"`
+				}
+				if resp, err := user.PostForm("/list_api_tokens", url.Values{}); err != nil {
+					fail(exitNetwork, "Error contacting API:", err)
+				} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+					fail(exitNetwork, "Error reading API response:", err)
+				} else if resp.StatusCode != http.StatusOK {
+					fail(apiFailure(resp.StatusCode), "API returned the status code", resp.StatusCode, "and the following response body:", strings.TrimSpace(string(b)))
+				} else if err := json.Unmarshal(b, &sessions); err != nil {
+					fail(exitAPI, "The API returned with a success, but we were unable to unmarshal the response:", err)
+				} else {
+					fmt.Println("API tokens issued to '" + user.Name + "':")
+					for _, s := range sessions.Data {
+						line := "  " + s.ID + " - issued " + describeTime(s.CreatedAt) + ", last used " + describeTime(s.LastUsedAt)
+						if s.Current {
+							line += " (this machine)"
 						}
+						fmt.Println(line)
 					}
-					if resp, err := http.PostForm(conf.ApiEndpoint+"/register", url.Values{
+					emit(append([]session{}, sessions.Data...))
+				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't grab credentials to list sessions with:", err)
+			})
+		},
+	}
+	sessionsRevokeCmd := &cobra.Command{
+		Use:   "revoke [id]",
+		Short: "Revokes one of those API tokens",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			withUser(func(user *User) {
+				if resp, err := user.PostForm("/revoke_api_token", url.Values{
+					"token_id": []string{args[0]},
+				}); err != nil {
+					fail(exitNetwork, "Error contacting API:", err)
+				} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+					fail(exitNetwork, "Error reading API response:", err)
+				} else if resp.StatusCode != http.StatusOK {
+					fail(apiFailure(resp.StatusCode), "API returned the status code", resp.StatusCode, "and the following response body:", strings.TrimSpace(string(b)))
+				} else {
+					fmt.Println("Revoked API token " + args[0] + ". If it was this machine's, run `kycli logout --local`.")
+					emit(map[string]interface{}{"ok": true, "token_id": args[0]})
+				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't grab credentials to revoke a session with:", err)
+			})
+		},
+	}
+	sessionsCmd.AddCommand(sessionsListCmd, sessionsRevokeCmd)
+	registerCmd := &cobra.Command{
+		Use:   "register",
+		Short: "Registers a new UFKYC passport",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			//We need the config so we can save the user and also so that we can know what endpoint to contact
+			withConfig(func(conf *Config) {
+				if conf.User.Name != "" {
+					fail(exitUsage, "You have already logged in as user '"+conf.User.Name+"'.")
+				} else {
+					if username, err := promptUsername(); err != nil {
+						fail(exitUsage, "Couldn't read username:", err)
+					} else if username == "" {
+						fail(exitUsage, "Usernames can't be empty.")
+					} else if password, err := promptPassword(true); err != nil {
+						fail(exitUsage, "Couldn't read password:", err)
+					} else if resp, err := http.PostForm(conf.ApiEndpoint+"/register", url.Values{
 						"username": []string{username},
 						"password": []string{password},
 					}); err != nil {
-						fmt.Println("error requesting api:", err)
+						fail(exitNetwork, "error requesting api:", err)
 					} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
-						fmt.Println("error reading response body:" + err.Error())
+						fail(exitNetwork, "error reading response body:"+err.Error())
 					} else if responseStr := string(b); responseStr == "user already exists" {
-						fmt.Println("User already exists; try a different username.")
+						fail(exitAPI, "User already exists; try a different username.")
 					} else if resp.StatusCode != http.StatusOK {
-						fmt.Println("received non-200 status code and the following response body:", responseStr)
+						fail(apiFailure(resp.StatusCode), "received non-200 status code and the following response body:", responseStr)
 					} else if token := string(b); !validAPIToken(token) {
-						fmt.Println("the api returned a success status code, but the following, structurally invalid api token:", token)
+						fail(exitAPI, "the api returned a success status code, but the following, structurally invalid api token:", token)
 					} else {
-						conf.User = User{
-							Name:     username,
-							ApiToken: token,
+						if err := saveLogin(conf, username, token); err != nil {
+							fail(exitStorage, "Registered the user, but there was a problem saving them: ", err)
+						} else {
+							emit(map[string]interface{}{"ok": true, "profile": conf.Name, "username": username})
 						}
-						withDB(func(db *gorm.DB) {
-							if err := db.Save(conf).Error; err != nil {
-								fmt.Println("Registered the user, but there was a problem saving them to the database: ", err)
-							}
-						}, func(err error) {
-							fmt.Println("Registered the user, but there was a problem accessing the database: ", err)
-						})
 					}
 				}
 			}, func(err error) {
-				fmt.Println("Couldn't start registering user:", err)
+				fail(exitStorage, "Couldn't start registering user:", err)
 			})
-		case "donate":
+		},
+	}
+	donateCmd := &cobra.Command{
+		Use:       "donate (fiat|crypto) [amount] [email]",
+		Short:     "Donate to add to your credibility score (and buy some Kenyan kid a malaria net)",
+		Args:      cobra.RangeArgs(1, 3),
+		ValidArgs: []string{"fiat", "crypto"},
+		Run: func(cmd *cobra.Command, args []string) {
 			var amount float64
 			var method string
 			philanthropize := func() {
 				if amount < 10 && method == "crypto" {
-					fmt.Println("The cryptocurrency payment processor we use only accepts payments of ten or more dollars. Sorry.")
+					fail(exitUsage, "The cryptocurrency payment processor we use only accepts payments of ten or more dollars. Sorry.")
 				} else {
 					withUser(func(user *User) {
 						//TODO: It'd probably be best if we consolidated these methods somehow, but also seems like meme-DRY-compressionism
@@ -340,282 +834,1241 @@ func main() {
 								"amount":         []string{strconv.FormatFloat(amount, 'f', 5, 64)},
 								"payment_vendor": []string{"stripe"},
 							}); err != nil {
-								fmt.Println("Error contacting API (no payment was made):", err)
+								fail(exitNetwork, "Error contacting API (no payment was made):", err)
 							} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
-								fmt.Println("Error reading API response (no payment was made):", err)
+								fail(exitNetwork, "Error reading API response (no payment was made):", err)
 							} else if resp.StatusCode != http.StatusOK {
-								fmt.Println("API returned with an error (no payment was made) and the following response body:", string(b))
+								fail(apiFailure(resp.StatusCode), "API returned with an error (no payment was made) and the following response body:", string(b))
 							} else if url := strings.TrimSpace(string(b)); validation.Validate(url, is.URL) != nil {
-								fmt.Println("Strange; the API returned a non-url to browse to to continue payment, but delivered an OK status code. Here was the URL:")
-								fmt.Println(url)
-							} else if isInsideSnap {
-								if err := clipboard.WriteAll(url); err != nil {
-									fmt.Println("Attempted to copy checkout url to clipboard, but there was an error: " + err.Error())
-									fmt.Println("Please finish your payment at: " + url)
-								} else {
-									fmt.Println("Please browse to the URL pasted into your clipboard and finish your payment.")
-								}
-							} else if err := browseTo(url); err != nil {
-								fmt.Println("An error occured opening the payment URL: ", err)
-								if err := clipboard.WriteAll(url); err != nil {
-									fmt.Println("Attempted to then copy checkout url to clipboard, but there was an error: " + err.Error())
-									fmt.Println("Please finish your payment at: " + url)
+								fail(exitAPI, "Strange; the API returned a non-url to browse to to continue payment, but delivered an OK status code. Here was the URL:")
+								fmt.Fprintln(os.Stderr, url)
+							} else {
+								emit(map[string]interface{}{"method": method, "amount": amount, "checkout_url": url})
+								if isInsideSnap {
+									if err := clipboard.WriteAll(url); err != nil {
+										fmt.Fprintln(os.Stderr, "Attempted to copy checkout url to clipboard, but there was an error: "+err.Error())
+										fmt.Println("Please finish your payment at: " + url)
+									} else {
+										fmt.Println("Please browse to the URL pasted into your clipboard and finish your payment.")
+									}
+								} else if err := browseTo(url); err != nil {
+									fmt.Fprintln(os.Stderr, "An error occured opening the payment URL: ", err)
+									if err := clipboard.WriteAll(url); err != nil {
+										fmt.Fprintln(os.Stderr, "Attempted to then copy checkout url to clipboard, but there was an error: "+err.Error())
+										fmt.Println("Please finish your payment at: " + url)
+									} else {
+										fmt.Println("Please browse to the URL pasted into your clipboard and finish your payment.")
+									}
 								} else {
-									fmt.Println("Please browse to the URL pasted into your clipboard and finish your payment.")
+									fmt.Println("Please attempt to finish your payment in the opened browser tab.")
+									fmt.Println("Your payment should be confirmed by the network within ~10 minutes,")
+									fmt.Println("depending on fees.")
 								}
-							} else {
-								fmt.Println("Please attempt to finish your payment in the opened browser tab.")
-								fmt.Println("Your payment should be confirmed by the network within ~10 minutes,")
-								fmt.Println("depending on fees.")
 							}
 						} else if method == "crypto" {
-							fmt.Println("Enter an email address to be associated with the payment, in case of disputes. You may use a tempmail if desired:")
 							var email string
-							for {
-								fmt.Scanln(&email)
-								if err := validation.Validate(email, is.Email); err != nil || strings.TrimSpace(email) == "" {
+							var emailErr error
+							validEmail := func() bool {
+								return validation.Validate(email, is.Email) == nil && strings.TrimSpace(email) != ""
+							}
+							if len(args) > 2 {
+								email = args[2]
+							} else {
+								if !nonInteractive {
+									fmt.Println("Enter an email address to be associated with the payment, in case of disputes. You may use a tempmail if desired:")
+								}
+								for {
+									if email, emailErr = promptLine("", "email address", "the fifth argument, e.g. kycli donate crypto 10 you@example.com"); emailErr != nil || validEmail() {
+										break
+									}
 									fmt.Println("Email entered was invalid; try again:")
-								} else {
-									break
 								}
 							}
-							if resp, err := user.PostForm("/donate", url.Values{
+							if emailErr != nil {
+								fail(exitUsage, "Couldn't read email address (no payment was made):", emailErr)
+							} else if !validEmail() {
+								fail(exitUsage, "The email address passed was invalid (no payment was made).")
+							} else if resp, err := user.PostForm("/donate", url.Values{
 								"amount":         []string{strconv.FormatFloat(amount, 'f', 5, 64)},
 								"payment_vendor": []string{"globee"},
 								"email":          []string{email},
 							}); err != nil {
-								fmt.Println("Error contacting API (no payment was made):", err)
+								fail(exitNetwork, "Error contacting API (no payment was made):", err)
 							} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
-								fmt.Println("Error reading API response (no payment was made):", err)
+								fail(exitNetwork, "Error reading API response (no payment was made):", err)
 							} else if resp.StatusCode != http.StatusOK {
-								fmt.Println("API returned with an error (no payment was made) and the following response body:", string(b))
+								fail(apiFailure(resp.StatusCode), "API returned with an error (no payment was made) and the following response body:", string(b))
 							} else if url := strings.TrimSpace(string(b)); validation.Validate(url, is.URL) != nil {
-								fmt.Println("Strange; the API returned a non-url to browse to to continue payment, but delivered an OK status code. Here was the URL:")
-								fmt.Println(url)
-							} else if isInsideSnap {
-								clipboard.WriteAll(url)
-								fmt.Println("Please browse to the URL pasted into your clipboard and finish your cryptocurrency payment.")
-								fmt.Println("Your donation will be confirmed shortly therafter.")
-							} else if err := browseTo(url); err != nil {
-								fmt.Println("An error occured opening the payment URL: ", err)
-								fmt.Println("Please attempt to go to", url, " in whatever browser you have available manually to finish your payment.")
-								fmt.Println("Your payment should be confirmed by the network credited within ~10 minutes,")
-								fmt.Println("depending on fees.")
+								fail(exitAPI, "Strange; the API returned a non-url to browse to to continue payment, but delivered an OK status code. Here was the URL:")
+								fmt.Fprintln(os.Stderr, url)
 							} else {
-								fmt.Println("Please attempt to finish your cryptocurrency payment in the opened browser tab.")
-								fmt.Println("Your payment should be confirmed by the network within ~10 minutes,")
-								fmt.Println("depending on fees.")
+								emit(map[string]interface{}{"method": method, "amount": amount, "checkout_url": url})
+								if isInsideSnap {
+									clipboard.WriteAll(url)
+									fmt.Println("Please browse to the URL pasted into your clipboard and finish your cryptocurrency payment.")
+									fmt.Println("Your donation will be confirmed shortly therafter.")
+								} else if err := browseTo(url); err != nil {
+									fmt.Fprintln(os.Stderr, "An error occured opening the payment URL: ", err)
+									fmt.Println("Please attempt to go to", url, " in whatever browser you have available manually to finish your payment.")
+									fmt.Println("Your payment should be confirmed by the network credited within ~10 minutes,")
+									fmt.Println("depending on fees.")
+								} else {
+									fmt.Println("Please attempt to finish your cryptocurrency payment in the opened browser tab.")
+									fmt.Println("Your payment should be confirmed by the network within ~10 minutes,")
+									fmt.Println("depending on fees.")
+								}
 							}
 						}
 					}, func(err error) {
-						fmt.Println("Couldn't begin donation process:", err)
+						fail(exitAuth, "Couldn't begin donation process:", err)
 					})
 				}
 			}
-			if len(os.Args) < 3 {
-				fmt.Println("You need to specify in the third argument whether to pay in cryptocurrency or fiat, e.g.:")
-				fmt.Println("kycli donate crypto [amount]")
-				fmt.Println("Or:")
-				fmt.Println("kycli donate fiat [amount]")
-			} else if method = strings.ToLower(os.Args[2]); method != "crypto" && method != "fiat" {
-				fmt.Println("Unrecognized payment method. Please specify 'crypto' or 'fiat'.")
-			} else if len(os.Args) < 4 {
-				fmt.Println("Enter amount you want to amount, in U.S. dollars: ")
-				if n, err := fmt.Scanf("%f\n", &amount); n != 1 || err != nil {
-					fmt.Println("Couldn't parse payment amount;", err)
+			if method = strings.ToLower(args[0]); method != "crypto" && method != "fiat" {
+				fail(exitUsage, "Unrecognized payment method. Please specify 'crypto' or 'fiat'.")
+			} else if len(args) < 2 {
+				if line, err := promptLine("Enter amount you want to amount, in U.S. dollars: ", "amount", "the fourth argument, e.g. kycli donate "+method+" 10"); err != nil {
+					fail(exitUsage, "Couldn't read payment amount:", err)
+				} else if amount, err = strconv.ParseFloat(strings.TrimRight(line, "$"), 64); err != nil {
+					fail(exitUsage, "Couldn't parse payment amount;", err)
 				} else {
 					philanthropize()
 				}
 			} else {
 				var err error
-				if amount, err = strconv.ParseFloat(strings.TrimRight(os.Args[3], "$"), 64); err != nil {
-					fmt.Println("An amount argument was provided, but it wasn't a decimal number. Try again.")
+				if amount, err = strconv.ParseFloat(strings.TrimRight(args[1], "$"), 64); err != nil {
+					fail(exitUsage, "An amount argument was provided, but it wasn't a decimal number. Try again.")
 				} else {
 					philanthropize()
 				}
 			}
-		case "service":
-			if len(os.Args) < 3 {
-				fmt.Println("Subcommand to 'service' is required (register, etc.)")
-				printHelp()
-			} else {
-				switch os.Args[2] {
-				case "register":
-					withUser(func(user *User) {
-						if resp, err := user.PostForm("/register_service", url.Values{}); err != nil {
-							fmt.Println("Error encountered while contacting api:", err)
-						} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
-							fmt.Println("Error reading response body:", err)
-						} else if respStr := strings.TrimSpace(string(b)); resp.StatusCode != http.StatusOK {
-							fmt.Printf("API returned the status code %d and the following response body: %s\n", resp.StatusCode, respStr)
+		},
+	}
+	serviceCmd := &cobra.Command{
+		Use:   "service",
+		Short: "Manages the UFKYC services you run",
+		Args:  cobra.NoArgs,
+		Run:   requireSubcommand,
+	}
+	var newServiceAlias string
+	serviceRegisterCmd := &cobra.Command{
+		Use:   "register",
+		Short: "Registers a UFKYC service users will be able to generate tokens for",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withUser(func(user *User) {
+				if resp, err := user.PostForm("/register_service", url.Values{}); err != nil {
+					fail(exitNetwork, "Error encountered while contacting api:", err)
+				} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+					fail(exitNetwork, "Error reading response body:", err)
+				} else if respStr := strings.TrimSpace(string(b)); resp.StatusCode != http.StatusOK {
+					fail(apiFailure(resp.StatusCode), "API returned the status code", resp.StatusCode, "and the following response body:", respStr)
+				} else {
+					fmt.Println("Your service registration was sucessful, and your service's granted ID is '" + respStr + "'. Assign it some domain names to allow users to generate tokens for it.")
+					emit(map[string]interface{}{"service_id": respStr, "alias": newServiceAlias})
+					warnUnrecorded(recordService(user, respStr, newServiceAlias))
+					var count int64
+					if db.Model(&Service{}).Where("user_id = ?", user.ID).Count(&count); count > 1 && conf.DefaultService == "" {
+						fmt.Println("You own more than one service now, so service commands will need --service, or a default set with `kycli service default`.")
+					}
+				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't begin service registration process:", err)
+			})
+		},
+	}
+	serviceRegisterCmd.Flags().StringVar(&newServiceAlias, "alias", "", "A name of your choosing for the new service, to pass to --service instead of its ID")
+	var serviceSelector string
+	serviceListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Lists your services, their domains and donation requirements",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withUser(func(user *User) {
+				if services, err := syncServices(user); err != nil {
+					fail(exitAPI, "Couldn't list your services:", err)
+				} else {
+					for _, l := range services {
+						if l.ID == conf.DefaultService {
+							fmt.Println(describeService(l) + " [default]")
 						} else {
-							fmt.Println("Your service registration was sucessful, and your service's granted ID is '" + respStr + "'. Assign it some domain names to allow users to generate tokens for it.")
+							fmt.Println(describeService(l))
 						}
-					}, func(err error) {
-						fmt.Println("Couldn't begin service registration process:", err)
-					})
-				case "require_donation":
-					if len(os.Args) != 4 {
-						fmt.Println("You used the wrong number of arguments; this command needs 4.")
-						printHelp()
+						for _, d := range l.Domains {
+							fmt.Println("  " + describeDomainStatus(d))
+						}
+					}
+					if len(services) == 0 {
+						fmt.Println("You haven't registered any services; `kycli service register` makes one.")
+					}
+					emit(services)
+				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't grab credentials to list your services with:", err)
+			})
+		},
+	}
+	serviceInfoCmd := &cobra.Command{
+		Use:               "info [id or alias]",
+		Short:             "Shows one of your services in detail",
+		Long:              `Shows one of your services in detail: the one given, else the one --service picks.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: onlyFirstArg(completeServiceIDs),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 1 {
+				serviceSelector = args[0]
+			}
+			withUser(func(user *User) {
+				svc, err := selectService(user, serviceSelector)
+				if err != nil {
+					fail(exitUsage, "Couldn't tell which service to show:", err)
+					return
+				}
+				services, err := syncServices(user)
+				if err != nil {
+					fail(exitAPI, "Couldn't look up your services:", err)
+					return
+				}
+				for _, l := range services {
+					if l.ID != svc.ServiceID {
+						continue
+					}
+					fmt.Println("Service:           " + l.ID)
+					if l.Alias != "" {
+						fmt.Println("Alias:             " + l.Alias)
+					}
+					if conf.DefaultService == l.ID {
+						fmt.Println("Default:           yes, for the profile '" + conf.Name + "'")
+					}
+					fmt.Println("Registered:        " + describeTime(l.RegisteredAt))
+					fmt.Printf("Required donation: %0.2f$\n", l.RequiredDonation)
+					fmt.Println("Domains:")
+					for _, d := range l.Domains {
+						fmt.Println("  " + describeDomainStatus(d))
+					}
+					if len(l.Domains) == 0 {
+						fmt.Println("  (none yet; `kycli service register_domain` adds one)")
+					}
+					emit(l)
+					return
+				}
+				fail(exitUsage, "The service "+describeServiceName(svc)+" is gone; `kycli service list` shows the ones you have.")
+			}, func(err error) {
+				fail(exitAuth, "Couldn't grab credentials to look up your services with:", err)
+			})
+		},
+	}
+	registerServiceFlag(serviceInfoCmd, &serviceSelector)
+	var removeAlias bool
+	serviceAliasCmd := &cobra.Command{
+		Use:   "alias [id or alias] [new alias]",
+		Short: "Names one of your services, so --service can take the name instead of its ID",
+		Long: `Names one of your services, so --service can take the name instead of its ID.
+Aliases are only known to this machine. With --remove, takes the alias away.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if removeAlias {
+				return cobra.ExactArgs(1)(cmd, args)
+			}
+			return cobra.ExactArgs(2)(cmd, args)
+		},
+		ValidArgsFunction: onlyFirstArg(completeServiceIDs),
+		Run: func(cmd *cobra.Command, args []string) {
+			withUser(func(user *User) {
+				alias := ""
+				if !removeAlias {
+					alias = args[1]
+				}
+				if svc, err := selectService(user, args[0]); err != nil {
+					fail(exitUsage, "Couldn't find that service:", err)
+				} else if err := setServiceAlias(user, &svc, alias); err != nil {
+					fail(exitStorage, "Couldn't set the alias:", err)
+				} else {
+					if alias == "" {
+						fmt.Println("The service '" + svc.ServiceID + "' has no alias now.")
+					} else {
+						fmt.Println("The service '" + svc.ServiceID + "' can be called '" + alias + "' now.")
+					}
+					emit(map[string]interface{}{"service_id": svc.ServiceID, "alias": alias})
+				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't grab credentials to look up your services with:", err)
+			})
+		},
+	}
+	serviceAliasCmd.Flags().BoolVar(&removeAlias, "remove", false, "Take the service's alias away")
+	var clearDefault bool
+	serviceDefaultCmd := &cobra.Command{
+		Use:   "default [id or alias]",
+		Short: "Shows or sets the service that service commands act on without --service",
+		Long: `Shows or sets the service that service commands act on without --service, for
+the current profile. With --clear, unsets it, and commands will only pick a
+service by themselves when you own just one.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: onlyFirstArg(completeServiceIDs),
+		Run: func(cmd *cobra.Command, args []string) {
+			withUser(func(user *User) {
+				if clearDefault {
+					if err := db.Model(conf).Update("default_service", "").Error; err != nil {
+						fail(exitStorage, "Couldn't clear the default service:", err)
 					} else {
-						if amount, err := strconv.ParseFloat(strings.TrimSuffix(os.Args[3], "$"), 64); err != nil {
-							fmt.Println("Error parsing donation amount: " + err.Error())
-							printHelp()
+						fmt.Println("The profile '" + conf.Name + "' has no default service now.")
+						emit(map[string]interface{}{"profile": conf.Name, "service_id": ""})
+					}
+				} else if len(args) == 0 {
+					if conf.DefaultService == "" {
+						fmt.Println("The profile '" + conf.Name + "' has no default service.")
+					} else if svc, ok := findService(user, conf.DefaultService); ok {
+						fmt.Println("The profile '" + conf.Name + "' defaults to the service " + describeServiceName(svc) + ".")
+					} else {
+						fmt.Println("The profile '" + conf.Name + "' defaults to the service '" + conf.DefaultService + "'.")
+					}
+					emit(map[string]interface{}{"profile": conf.Name, "service_id": conf.DefaultService})
+				} else if svc, err := selectService(user, args[0]); err != nil {
+					fail(exitUsage, "Couldn't find that service:", err)
+				} else if err := db.Model(conf).Update("default_service", svc.ServiceID).Error; err != nil {
+					fail(exitStorage, "Couldn't set the default service:", err)
+				} else {
+					fmt.Println("Service commands for the profile '" + conf.Name + "' will act on " + describeServiceName(svc) + " unless given --service.")
+					emit(map[string]interface{}{"profile": conf.Name, "service_id": svc.ServiceID})
+				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't grab credentials to look up your services with:", err)
+			})
+		},
+	}
+	serviceDefaultCmd.Flags().BoolVar(&clearDefault, "clear", false, "Unset the default service")
+	serviceRequireDonationCmd := &cobra.Command{
+		Use:   "require_donation [amount]",
+		Short: "(Optional) Sets an amount users have to have donated in order to create tokens for your service",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if amount, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "$"), 64); err != nil {
+				fail(exitUsage, "Error parsing donation amount: "+err.Error())
+				cmd.Usage()
+			} else {
+				withUser(func(user *User) {
+					svc, err := selectService(user, serviceSelector)
+					if err != nil {
+						fail(exitUsage, "Couldn't tell which service to set the donation requirement for:", err)
+						return
+					}
+					if resp, err := user.PostForm("/require_donation", url.Values{
+						"service_id": []string{svc.ServiceID},
+						"amount":     []string{strconv.FormatFloat(amount, 'f', 2, 64)},
+					}); err != nil {
+						fail(exitNetwork, "Error trying to connect to API:", err)
+					} else if resp.StatusCode != 200 {
+						if b, err := ioutil.ReadAll(resp.Body); err != nil {
+							fail(apiFailure(resp.StatusCode), "API returned the status code "+strconv.Itoa(resp.StatusCode)+".")
 						} else {
-							withUser(func(user *User) {
-								if resp, err := user.PostForm("/require_donation", url.Values{
-									"amount": []string{strconv.FormatFloat(amount, 'f', 2, 64)},
-								}); err != nil {
-									fmt.Println("Error trying to connect to API:", err)
-								} else if resp.StatusCode != 200 {
-									if b, err := ioutil.ReadAll(resp.Body); err != nil {
-										fmt.Println("API returned the status code " + strconv.Itoa(resp.StatusCode) + ".")
-									} else {
-										fmt.Println("API returned the status code", resp.StatusCode, "and the following response body: "+string(b))
-									}
-								} else {
-									fmt.Printf("New users will now have to donate at least %0.2f$ platform wide in order to start creating tokens for your service.\n", amount)
-								}
-							}, func(err error) {
-								fmt.Println("Couldn't grab credentials to set donation requirement with:", err)
-							})
+							fail(apiFailure(resp.StatusCode), "API returned the status code", resp.StatusCode, "and the following response body: "+string(b))
 						}
+					} else {
+						svc.RequiredDonation = amount
+						warnUnrecorded(errors.Wrap(db.Save(&svc).Error, "error saving service into local db"))
+						fmt.Printf("New users will now have to donate at least %0.2f$ platform wide in order to start creating tokens for your service %s.\n", amount, describeServiceName(svc))
+						emit(map[string]interface{}{"service_id": svc.ServiceID, "required_donation": amount})
 					}
-				case "register_domain":
-					withUser(func(user *User) {
-						do := func(domain string) {
-							if resp, err := user.PostForm("/register_service_domain", url.Values{
-								"domain_name": []string{domain},
-							}); err != nil {
-								fmt.Println("Error trying to connect to API:", err)
-							} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
-								fmt.Println("Error trying to read API response body:", err)
-							} else if resp.StatusCode != http.StatusOK {
-								var errMsg struct {
-									Error string `json:"error"`
-								}
-								if err := json.Unmarshal(b, &errMsg); err != nil {
-									fmt.Println("API returned non-200 status code, and we were unable to unmarshal the error message. Here it is raw: " + strings.TrimSpace(string(b)))
-									fmt.Println("And here's the error encountered during unmarshaling:", err)
-								} else {
-									fmt.Println("The API returned an error: " + errMsg.Error)
-								}
-							} else {
-								var resp struct {
-									Data struct {
-										PathValidation struct {
-											Path    string `json:"path"`
-											Content string `json:"content"`
-										} `json:"path_validation"`
-										TxtValidation struct {
-											Nonce string `json:"nonce"`
-										} `json:"txt_validation"`
-									} `json:"data"`
-								}
-								fmt.Println(string(b))
-								if err := json.Unmarshal(b, &resp); err != nil {
-									fmt.Println("The API returned with a success, but we were unable to marshal the response. Here is what it sent us, raw: " + spew.Sdump(resp))
-								} else {
-									if resp.Data.PathValidation.Content != "" {
-										fmt.Println("Your domain name has been registered.")
-										fmt.Println("In order to validate ownership, you'll need to place a file at the '" + resp.Data.PathValidation.Path + "' path of a web server running on port 80 or 443.")
-										fmt.Println("The file must contain the following nonce: '" + resp.Data.PathValidation.Content + "'")
-										fmt.Println("UFKYC will continually poll that location from the internet until it responds correctly, at which point your domain will be validated.")
-										fmt.Println("If you do not validate ownership within an hour, your domain will become unregistered and you'll need to start this process again.")
-										fmt.Println("You can re-run this command to get the above information again from UFKYC.")
-									} else if resp.Data.TxtValidation.Nonce != "" {
-										fmt.Println("Your domain name has been registered.")
-										fmt.Println("In order to validate ownership, you'll need make a TXT record at the root domain")
-										fmt.Println("with the contents '" + resp.Data.TxtValidation.Nonce + "'.")
-										fmt.Println("We will continually poll its TXT records until it responds correctly.")
-										fmt.Println("If you do not validate ownership within an hour, your domain will become unregistered and you'll need to start this process again.")
-										fmt.Println("You can re-run this command to get the above information again from UFKYC.")
-									}
-								}
+				}, func(err error) {
+					fail(exitAuth, "Couldn't grab credentials to set donation requirement with:", err)
+				})
+			}
+		},
+	}
+	registerServiceFlag(serviceRequireDonationCmd, &serviceSelector)
+	var responder responderOptions
+	serviceRegisterDomainCmd := &cobra.Command{
+		Use:   "register_domain [name]",
+		Short: "Adds an unvalidated domain to your UFKYC service, and starts the validation process",
+		Long: `Adds an unvalidated domain to your UFKYC service, and prints the challenges
+you can answer to validate it within the hour.
 
-							}
+With --serve, kycli answers the path challenge itself with a small web server
+(on port 80 by default) until the domain validates or the hour runs out; it's
+for when there's no web server on the domain yet. With --webroot, it instead
+writes the challenge file into an existing web server's document root, and
+removes it afterwards.
+
+With --dns, a DNS provider makes the TXT record instead, and removes it once
+the domain validates:
+  rfc2136  sends dynamic updates to --dns-server, signed with --tsig-key
+  hook     runs --dns-hook with "present" or "cleanup" as its argument, and the
+           domain and record in $KYCLI_DOMAIN and $KYCLI_VALIDATION`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: onlyFirstArg(completeDomains),
+		Run: func(cmd *cobra.Command, args []string) {
+			if responder.count() > 1 {
+				fail(exitUsage, "Pass only one of --serve, --webroot and --dns.")
+				return
+			} else if err := responder.check(); err != nil {
+				fail(exitUsage, "Couldn't get ready to answer the challenge:", err)
+				return
+			}
+			withUser(func(user *User) {
+				svc, err := selectService(user, serviceSelector)
+				if err != nil {
+					fail(exitUsage, "Couldn't tell which service to add the domain to:", err)
+					return
+				}
+				do := func(domain string) {
+					if resp, err := user.PostForm("/register_service_domain", url.Values{
+						"service_id":  []string{svc.ServiceID},
+						"domain_name": []string{domain},
+					}); err != nil {
+						fail(exitNetwork, "Error trying to connect to API:", err)
+					} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
+						fail(exitNetwork, "Error trying to read API response body:", err)
+					} else if resp.StatusCode != http.StatusOK {
+						var errMsg struct {
+							Error string `json:"error"`
+						}
+						if err := json.Unmarshal(b, &errMsg); err != nil {
+							fail(apiFailure(resp.StatusCode), "API returned non-200 status code, and we were unable to unmarshal the error message. Here it is raw: "+strings.TrimSpace(string(b)))
+							fmt.Fprintln(os.Stderr, "And here's the error encountered during unmarshaling:", err)
+						} else {
+							fail(apiFailure(resp.StatusCode), "The API returned an error: "+errMsg.Error)
 						}
-						if len(os.Args) == 4 {
-							if validation.Validate(os.Args[3], is.Domain) != nil || !isRootDomain(os.Args[3]) {
-								fmt.Println("Passed argument is not a valid root domain.")
+					} else {
+						var resp struct {
+							Data struct {
+								PathValidation struct {
+									Path    string `json:"path"`
+									Content string `json:"content"`
+								} `json:"path_validation"`
+								TxtValidation struct {
+									Nonce string `json:"nonce"`
+								} `json:"txt_validation"`
+							} `json:"data"`
+						}
+						if err := json.Unmarshal(b, &resp); err != nil {
+							fail(exitAPI, "The API returned with a success, but we were unable to marshal the response. Here is what it sent us, raw: "+spew.Sdump(resp))
+						} else {
+							result := map[string]interface{}{
+								"service_id":      svc.ServiceID,
+								"domain":          domain,
+								"path_validation": resp.Data.PathValidation,
+								"txt_validation":  resp.Data.TxtValidation,
+							}
+							challenge := domainChallenge{
+								Path:    resp.Data.PathValidation.Path,
+								Content: resp.Data.PathValidation.Content,
+								Nonce:   resp.Data.TxtValidation.Nonce,
+							}
+							warnUnrecorded(recordServiceDomain(user, svc.ServiceID, domain, challenge))
+							fmt.Println("The domain goes to your service " + describeServiceName(svc) + ".")
+							if responder.count() > 0 {
+								respondToChallenge(user, domain, challenge, responder, result)
 							} else {
-								do(os.Args[3])
+								emit(result)
+								if resp.Data.PathValidation.Content != "" {
+									fmt.Println("Your domain name has been registered.")
+									fmt.Println("In order to validate ownership, you'll need to place a file at the '" + resp.Data.PathValidation.Path + "' path of a web server running on port 80 or 443.")
+									fmt.Println("The file must contain the following nonce: '" + resp.Data.PathValidation.Content + "'")
+									fmt.Println("UFKYC will continually poll that location from the internet until it responds correctly, at which point your domain will be validated.")
+									fmt.Println("If you do not validate ownership within an hour, your domain will become unregistered and you'll need to start this process again.")
+									fmt.Println("You can re-run this command to get the above information again from UFKYC.")
+									fmt.Println("Run `kycli service domain status " + domain + " --wait` to follow along.")
+								} else if resp.Data.TxtValidation.Nonce != "" {
+									fmt.Println("Your domain name has been registered.")
+									fmt.Println("In order to validate ownership, you'll need make a TXT record at the root domain")
+									fmt.Println("with the contents '" + resp.Data.TxtValidation.Nonce + "'.")
+									fmt.Println("We will continually poll its TXT records until it responds correctly.")
+									fmt.Println("If you do not validate ownership within an hour, your domain will become unregistered and you'll need to start this process again.")
+									fmt.Println("You can re-run this command to get the above information again from UFKYC.")
+									fmt.Println("Run `kycli service domain status " + domain + " --wait` to follow along.")
+								}
 							}
+						}
+
+					}
+				}
+				if len(args) == 1 {
+					if root, err := rootDomain(args[0]); err != nil {
+						fail(exitUsage, "Passed argument is not a valid root domain:", err)
+					} else {
+						do(root)
+					}
+				} else {
+					var domain, confirmation string
+					var err error
+					sources := "the fourth argument, e.g. kycli service register_domain example.com"
+					for {
+						if domain, err = promptLine("Enter domain: ", "domain", sources); err != nil {
+							break
+						} else if _, err := rootDomain(domain); err != nil {
+							fmt.Println("Entry was not a valid root domain (" + err.Error() + "); try again.")
+						} else if confirmation, err = promptLine("Confirm: ", "domain", sources); err != nil {
+							break
+						} else if confirmation != domain {
+							fmt.Println("Domain and confirmation were different; try again.")
 						} else {
-							var domain string
-							for {
-								fmt.Print("Enter domain: ")
-								fmt.Scanln(&domain)
-								if validation.Validate(domain, is.Domain) != nil || !isRootDomain(domain) {
-									fmt.Println("Entry was not a valid root domain; try again.")
-								} else {
-									var confirm string
-									fmt.Print("Confirm: ")
-									fmt.Scanln(&confirm)
-									if confirm != domain {
-										fmt.Println("Domain and confirmation were different; try again.")
-									} else {
-										break
-									}
-								}
+							break
+						}
+					}
+					if err != nil {
+						fail(exitUsage, "Couldn't read domain:", err)
+					} else if root, err := rootDomain(domain); err != nil {
+						fail(exitUsage, "Entry was not a valid root domain:", err)
+					} else {
+						do(root)
+					}
+				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't begin domain name association process:", err)
+			})
+		},
+	}
+	serviceRegisterDomainCmd.Flags().StringVar(&responder.Serve, "serve", "", "Answer the path challenge with a built-in web server on this address until the domain validates")
+	serviceRegisterDomainCmd.Flags().Lookup("serve").NoOptDefVal = ":80"
+	serviceRegisterDomainCmd.Flags().StringVar(&responder.Webroot, "webroot", "", "Write the challenge file into this document root until the domain validates, then remove it")
+	serviceRegisterDomainCmd.MarkFlagDirname("webroot")
+	registerDNSFlags(serviceRegisterDomainCmd, &responder.DNS)
+	registerServiceFlag(serviceRegisterDomainCmd, &serviceSelector)
+	serviceDomainCmd := &cobra.Command{
+		Use:   "domain",
+		Short: "Follows your service's domains through validation",
+		Args:  cobra.NoArgs,
+		Run:   requireSubcommand,
+	}
+	var domainWait bool
+	var domainInterval time.Duration
+	serviceDomainStatusCmd := &cobra.Command{
+		Use:   "status [domain]",
+		Short: "Shows whether your domains are pending, validated or expired",
+		Long: `Shows whether your domains (or just the one given) are pending, validated or
+expired, and how long pending ones have left in their one hour validation
+window. With --wait, keeps checking until they're all validated, and exits
+with 1 if one expires first. Checks that fail while waiting are retried until
+the validation window would have run out.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: onlyFirstArg(completeDomains),
+		Run: func(cmd *cobra.Command, args []string) {
+			var name string
+			if len(args) == 1 {
+				if root, err := rootDomain(args[0]); err != nil {
+					fail(exitUsage, "Passed argument is not a valid root domain:", err)
+					return
+				} else {
+					name = root
+				}
+			}
+			withUser(func(user *User) {
+				//Domains from every service, unless asked for one.
+				var only string
+				if serviceSelector != "" {
+					if svc, err := selectService(user, serviceSelector); err != nil {
+						fail(exitUsage, "Couldn't tell which service's domains to show:", err)
+						return
+					} else {
+						only = svc.ServiceID
+					}
+				}
+				var last string
+				//While waiting, a failed check is retried until the last
+				//pending domain's window would have run out.
+				var deadline time.Time
+				for {
+					statuses, err := fetchDomainStatus(user, name)
+					if err != nil && domainWait && time.Now().Before(deadline) {
+						fmt.Fprintln(os.Stderr, "Couldn't get the status of your domains; trying again:", err)
+						time.Sleep(domainInterval)
+						continue
+					} else if err != nil {
+						fail(exitAPI, "Couldn't get the status of your domains:", err)
+						return
+					}
+					if only != "" {
+						mine := []domainStatus{}
+						for _, d := range statuses {
+							if d.ServiceID == only {
+								mine = append(mine, d)
 							}
-							do(domain)
 						}
-					}, func(err error) {
-						fmt.Println("Couldn't begin domain name association process:", err)
-					})
-				default:
-					fmt.Println("Subcommand unrecognized.")
-					printHelp()
+						statuses = mine
+					}
+					pending, expired := 0, 0
+					var lines []string
+					for _, d := range statuses {
+						lines = append(lines, describeDomainStatus(d))
+						if d.State == "pending" {
+							pending++
+							if d.ExpiresAt.After(deadline) {
+								deadline = d.ExpiresAt
+							}
+						} else if d.State == "expired" {
+							expired++
+						}
+					}
+					//While waiting, only print when something other than the
+					//time left changed.
+					if summary := fmt.Sprint(pending, expired, len(statuses)); !domainWait || summary != last {
+						last = summary
+						for _, l := range lines {
+							fmt.Println(l)
+						}
+						if len(statuses) == 0 && only != "" {
+							fmt.Println("That service has no domains.")
+						} else if len(statuses) == 0 {
+							fmt.Println("You haven't registered any domains.")
+						}
+					}
+					if !domainWait || pending == 0 && expired == 0 {
+						emit(statuses)
+						return
+					} else if expired > 0 {
+						fail(exitFailure, "The validation window ran out before every domain could be validated.")
+						return
+					}
+					time.Sleep(domainInterval)
 				}
+			}, func(err error) {
+				fail(exitAuth, "Couldn't grab credentials to check your domains with:", err)
+			})
+		},
+	}
+	serviceDomainStatusCmd.Flags().BoolVar(&domainWait, "wait", false, "Keep checking until every domain is validated, failing if one expires")
+	serviceDomainStatusCmd.Flags().DurationVar(&domainInterval, "interval", 15*time.Second, "How often to check with --wait")
+	registerServiceFlag(serviceDomainStatusCmd, &serviceSelector)
+	var checker domainChecker
+	var checkChallenge domainChallenge
+	serviceDomainCheckCmd := &cobra.Command{
+		Use:   "check [domain]",
+		Short: "Checks a domain's validation challenges yourself, before UFKYC does",
+		Long: `Checks a domain's validation challenges the way UFKYC will: fetches the
+challenge file over https and http and compares it with the nonce, and looks
+up the TXT records at the root of the domain. Each check says what's wrong:
+DNS not resolving, port closed, a redirect, the wrong content, or a missing
+TXT record. The challenges are the ones register_domain last printed, or the
+ones given with --path/--content/--nonce. Exits with 1 if no check passes.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: onlyFirstArg(completeDomains),
+		Run: func(cmd *cobra.Command, args []string) {
+			domain, err := rootDomain(args[0])
+			if err != nil {
+				fail(exitUsage, "Passed argument is not a valid root domain:", err)
+				return
+			}
+			withConfig(func(conf *Config) {
+				challenge, _ := storedChallenge(&conf.User, domain)
+				if checkChallenge.Path != "" || checkChallenge.Content != "" {
+					challenge.Path, challenge.Content = checkChallenge.Path, checkChallenge.Content
+				}
+				if checkChallenge.Nonce != "" {
+					challenge.Nonce = checkChallenge.Nonce
+				}
+				if challenge.Path != "" && !strings.HasPrefix(challenge.Path, "/") {
+					challenge.Path = "/" + challenge.Path
+				}
+				if (challenge.Path == "" || challenge.Content == "") && challenge.Nonce == "" {
+					fail(exitUsage, "We don't know the challenges for "+displayDomain(domain)+"; run `kycli service register_domain "+domain+"` from this machine, or pass --path and --content, or --nonce.")
+					return
+				}
+				if challenge.Path == "" || challenge.Content == "" {
+					challenge.Path, challenge.Content = "", ""
+				}
+				diags := checker.check(domain, challenge)
+				passed := false
+				for _, d := range diags {
+					if d.OK {
+						passed = true
+						fmt.Println("OK    " + d.Method + " " + d.Target + ": " + d.Detail)
+					} else {
+						fmt.Println("FAIL  " + d.Method + " " + d.Target + ": " + d.Detail)
+					}
+				}
+				emit(map[string]interface{}{"domain": domain, "passed": passed, "checks": diags})
+				if passed {
+					fmt.Println("At least one challenge passes, so UFKYC should validate " + displayDomain(domain) + " on its next try.")
+				} else {
+					fail(exitFailure, "No challenge passes yet, so UFKYC won't be able to validate "+displayDomain(domain)+".")
+				}
+			}, func(err error) {
+				fail(exitStorage, "Couldn't load the profile:", err)
+			})
+		},
+	}
+	serviceDomainCheckCmd.Flags().StringVar(&checker.Resolver, "resolver", "", "DNS server to resolve with, as host[:port] (default the system's)")
+	serviceDomainCheckCmd.Flags().DurationVar(&checker.Timeout, "timeout", 10*time.Second, "How long to give each check")
+	serviceDomainCheckCmd.Flags().StringVar(&checkChallenge.Path, "path", "", "Path the challenge file should be served at")
+	serviceDomainCheckCmd.Flags().StringVar(&checkChallenge.Content, "content", "", "Nonce the challenge file should contain")
+	serviceDomainCheckCmd.Flags().StringVar(&checkChallenge.Nonce, "nonce", "", "Nonce the TXT record should contain")
+	serviceDomainCmd.AddCommand(serviceDomainStatusCmd, serviceDomainCheckCmd)
+	serviceCmd.AddCommand(serviceRegisterCmd, serviceListCmd, serviceInfoCmd, serviceAliasCmd, serviceDefaultCmd, serviceRequireDonationCmd, serviceRegisterDomainCmd, serviceDomainCmd)
+	var devValidationDelay, devValidationWindow time.Duration
+	devserverCmd := &cobra.Command{
+		Use:   "devserver [address] [key file]",
+		Short: "Runs an in-memory mock of the UFKYC API for offline testing (default address 127.0.0.1:8091)",
+		Args:  cobra.MaximumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			addr := "127.0.0.1:8091"
+			if len(args) > 0 {
+				addr = args[0]
+			}
+			var keyPath string
+			if len(args) > 1 {
+				keyPath = args[1]
+			}
+			if key, err := loadDevServerKey(keyPath); err != nil {
+				fail(exitStorage, "Couldn't start devserver:", err)
+			} else {
+				fmt.Println("Serving a mock UFKYC API at http://" + addr + devServerPrefix)
+				fmt.Println("Point kycli at it with: DANGEROUS=TRUE kycli api_switch http://" + addr + devServerPrefix)
+				fmt.Println("Its tokens are signed with the public key", hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+				srv := newDevServer(key)
+				srv.validationDelay, srv.validationWindow = devValidationDelay, devValidationWindow
+				if err := http.ListenAndServe(addr, srv.handler()); err != nil {
+					fail(exitNetwork, "Devserver stopped:", err)
+				}
+			}
+		},
+	}
+	devserverCmd.Flags().DurationVar(&devValidationDelay, "validation-delay", 0, "How long domains take to validate; longer than the window and they expire instead")
+	devserverCmd.Flags().DurationVar(&devValidationWindow, "validation-window", defaultValidationWindow, "How long domains have to validate before they expire")
+	pslCmd := &cobra.Command{
+		Use:   "psl",
+		Short: "Manages the Public Suffix List used to find registrable domains",
+		Args:  cobra.NoArgs,
+		Run:   requireSubcommand,
+	}
+	pslShowCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Shows which copy of the Public Suffix List is in use",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			list := publicSuffixes()
+			fmt.Println("Using the", list.Source, "public suffix list, with", list.Len(), "rules.")
+			emit(map[string]interface{}{"source": list.Source, "rules": list.Len()})
+		},
+	}
+	pslRefreshCmd := &cobra.Command{
+		Use:   "refresh [file]",
+		Short: "Replaces the bundled Public Suffix List with a newer copy from a local file",
+		Long: `Replaces the bundled Public Suffix List with a newer copy from a local file,
+e.g. one downloaded from https://publicsuffix.org/list/public_suffix_list.dat.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if list, err := refreshPublicSuffixList(args[0]); err != nil {
+				fail(exitStorage, "Couldn't refresh the public suffix list:", err)
+			} else {
+				fmt.Println("Now using the public suffix list from", args[0], "with", list.Len(), "rules.")
+				emit(map[string]interface{}{"source": list.Source, "rules": list.Len()})
+			}
+		},
+	}
+	pslResetCmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Goes back to the bundled Public Suffix List",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := resetPublicSuffixList(); err != nil {
+				fail(exitStorage, "Couldn't reset the public suffix list:", err)
+			} else {
+				fmt.Println("Now using the bundled public suffix list.")
+				list := publicSuffixes()
+				emit(map[string]interface{}{"reset": true, "source": list.Source, "rules": list.Len()})
 			}
-		case "clear":
+		},
+	}
+	pslCmd.AddCommand(pslShowCmd, pslRefreshCmd, pslResetCmd)
+	clearCmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Deletes the local database (needs DANGEROUS=TRUE)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
 			dangerous(func() {
 				withDBPath(func(path string) {
-					if err := os.Remove(path); err != os.ErrNotExist {
-						fmt.Println("Couldn't remove database:", err)
+					if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+						fail(exitStorage, "Couldn't remove database:", err)
+					} else {
+						emit(map[string]interface{}{"cleared": true, "path": path})
 					}
 				}, func(err error) {
-					fmt.Println("Couldn't find the path to the database:", err)
+					fail(exitStorage, "Couldn't find the path to the database:", err)
 				})
 			})
-		case "token":
-			withUser(func(user *User) {
-				if clipboard.Unsupported {
-					fmt.Println("Sorry, clipboard functionality was not found for your current running environment.")
-					if runtime.GOOS == "linux" {
-						fmt.Println("Make sure you have the clipboard program installed for your preferred display manager (xclip, xsel, wl-clip, etc.)")
-					}
-				} else if domain, err := clipboard.ReadAll(); err != nil {
-					fmt.Println("We encountered an error reading your clipboard:", err)
-				} else if domain = strings.TrimSpace(domain); validation.Validate(domain, is.Domain) != nil || !isRootDomain(domain) {
-					fmt.Println("The item in your clipboard was not a domain. Make sure you copy the root domain in your browser before trying to generate a token.")
-					fmt.Println("It's a pain, but this way hopefully you'll never get phished again.")
+		},
+	}
+	var tokenDomain, tokenOutFile string
+	var tokenStdin, tokenPrint bool
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "Grab a UFKYC token for the domain in your clipboard",
+		Long: `Grabs a UFKYC token for a domain. By default the domain is read from your
+clipboard and the token is copied back into it; --domain or --stdin and
+--print or --out-file do without the clipboard. You can give a bare domain or
+paste the whole address (https://www.example.com/login, www.example.com:8080,
+user@example.com); the token is for the registrable domain it belongs to, here
+example.com. You're always shown that domain and asked to confirm it unless
+you pass --yes.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fromClipboard := tokenDomain == "" && !tokenStdin
+			toClipboard := !tokenPrint && tokenOutFile == ""
+			if tokenPrint {
+				//The token gets stdout to itself.
+				os.Stdout = os.Stderr
+			}
+			var previousClipboard string
+			deliver := func(token string) error {
+				if tokenOutFile != "" {
+					if err := ioutil.WriteFile(tokenOutFile, []byte(token+"\n"), 0600); err != nil {
+						return withExitCode(exitStorage, errors.Wrap(err, "error writing token to "+tokenOutFile))
+					}
+					fmt.Println("Token written to " + tokenOutFile + ".")
+				}
+				if tokenPrint && !structuredOutput() {
+					fmt.Fprintln(resultOut, token)
+				}
+				if toClipboard {
+					previousClipboard, _ = clipboard.ReadAll()
+					if err := clipboard.WriteAll(token); err != nil {
+						return withExitCode(exitEnvironment, errors.Wrap(err, "error writing token to clipboard"))
+					}
+					fmt.Println("Token copied to clipboard.")
+				}
+				return nil
+			}
+			if tokenDomain != "" && tokenStdin {
+				fail(exitUsage, "Pass the domain with either --domain or --stdin, not both.")
+			} else if (fromClipboard || toClipboard) && clipboard.Unsupported {
+				fail(exitEnvironment, "Sorry, clipboard functionality was not found for your current running environment.")
+				if runtime.GOOS == "linux" {
+					fmt.Fprintln(os.Stderr, "Make sure you have the clipboard program installed for your preferred display manager (xclip, xsel, wl-clip, etc.)")
+				}
+				fmt.Fprintln(os.Stderr, "Or pass the domain with --domain or --stdin, and get the token with --print or --out-file.")
+			} else {
+				withUser(func(user *User) {
+					input := tokenDomain
+					var err error
+					if tokenStdin {
+						if input, err = readLine(); err != nil {
+							err = withExitCode(exitUsage, errors.Wrap(err, "error reading domain from stdin"))
+						}
+					} else if fromClipboard {
+						if input, err = clipboard.ReadAll(); err != nil {
+							err = withExitCode(exitEnvironment, errors.Wrap(err, "error reading clipboard"))
+						}
+					}
+					host, domain, domainErr := domainFromInput(input)
+					if err != nil {
+						fail(exitUsage, "We couldn't grab the domain:", err)
+					} else if domainErr != nil && fromClipboard {
+						fail(exitUsage, "The item in your clipboard was not a domain or URL:", domainErr)
+						fmt.Fprintln(os.Stderr, "Make sure you copy the address from your browser before trying to generate a token.")
+					} else if domainErr != nil {
+						fail(exitUsage, "Can't grab a token for that:", domainErr)
+						fmt.Fprintln(os.Stderr, "Pass the domain or address exactly as your browser shows it.")
+					} else if ok, err := confirmTokenDomain(user, input, host, domain); err != nil {
+						fail(exitUsage, "Couldn't confirm the token request:", err)
+					} else if !ok {
+						fail(exitFailure, "Not grabbing a token for "+displayDomain(domain)+".")
+					} else if rstr, err := grabToken(user, domain); err != nil {
+						fail(exitAPI, "Couldn't grab a token:", err)
+					} else {
+						if err := deliver(rstr); err != nil {
+							fail(exitFailure, "Error encountered delivering the token:", err)
+						} else {
+							emit(map[string]interface{}{"domain": domain, "site": host, "token": rstr})
+							if toClipboard {
+								if err := clearClipboardLater(rstr, previousClipboard); err != nil {
+									fmt.Fprintln(os.Stderr, "Warning: the token will stay in your clipboard:", err)
+								}
+							}
+						}
+					}
+				}, func(err error) {
+					fail(exitAuth, "Couldn't grab UFKYC credentials to request token with:", err)
+				})
+			}
+		},
+	}
+	tokenCmd.Flags().StringVar(&tokenDomain, "domain", "", "Grab a token for this domain or URL instead of the one in your clipboard")
+	tokenCmd.Flags().BoolVar(&tokenStdin, "stdin", false, "Read the domain or URL from the first line of stdin")
+	tokenCmd.Flags().BoolVar(&tokenPrint, "print", false, "Print the token on stdout instead of copying it to the clipboard")
+	tokenCmd.Flags().StringVar(&tokenOutFile, "out-file", "", "Write the token to this file (mode 0600) instead of copying it to the clipboard")
+	tokenCmd.Flags().BoolVar(&allowLookalike, "allow-lookalike", false, "Don't stop to confirm domains that look like ones you've used before")
+	registerClipboardFlags(tokenCmd)
+	tokenCmd.RegisterFlagCompletionFunc("domain", completeDomains)
+	inspectToken := func(cmd *cobra.Command, args []string) {
+		var raw string
+		var err error
+		if len(args) > 0 && args[0] == "-" {
+			var b []byte
+			b, err = ioutil.ReadAll(os.Stdin)
+			raw = string(b)
+		} else if len(args) > 0 {
+			raw = args[0]
+		} else if clipboard.Unsupported {
+			err = errors.New("no token was passed and clipboard functionality was not found for your current running environment")
+		} else {
+			raw, err = clipboard.ReadAll()
+		}
+		if err != nil {
+			fail(exitUsage, "Couldn't read token:", err)
+		} else if token, err := verify.Parse(raw); err != nil {
+			fail(exitUsage, "That doesn't look like a UFKYC token:", err)
+		} else if claims, err := token.Claims(); err != nil {
+			fail(exitUsage, "Couldn't read the token's claims:", err)
+		} else {
+			fmt.Println("Version:     ", token.Version())
+			fmt.Println("Audience:    ", claims.Audience, "(service ID)")
+			fmt.Println("Subject:     ", claims.Subject)
+			if claims.Issuer != "" {
+				fmt.Println("Issuer:      ", claims.Issuer)
+			}
+			fmt.Println("Issued at:   ", describeTime(claims.IssuedAt))
+			if !claims.NotBefore.IsZero() {
+				fmt.Println("Not before:  ", describeTime(claims.NotBefore))
+			}
+			fmt.Println("Expires:     ", describeTime(claims.Expiration))
+			if len(token.Footer) > 0 {
+				fmt.Println("Footer:      ", string(token.Footer))
+			}
+			result := map[string]interface{}{
+				"version": token.Version(),
+				"claims":  claims,
+				"footer":  string(token.Footer),
+			}
+			if cmd.Name() == "verify" {
+				check := func(keys []ed25519.PublicKey) {
+					i := token.SignedBy(keys)
+					expired := !claims.Expiration.IsZero() && time.Now().After(claims.Expiration)
+					early := !claims.NotBefore.IsZero() && time.Now().Before(claims.NotBefore)
+					if i < 0 {
+						fmt.Println("Signature:    INVALID; this token was not signed by any of the", len(keys), "platform key(s)")
+					} else if expired {
+						fmt.Println("Signature:    valid (key", strconv.Itoa(i+1)+"), but the token has EXPIRED")
+					} else if early {
+						fmt.Println("Signature:    valid (key", strconv.Itoa(i+1)+"), but the token is NOT VALID YET")
+					} else {
+						fmt.Println("Signature:    valid (key", strconv.Itoa(i+1)+")")
+					}
+					result["signature_valid"] = i >= 0
+					result["key"] = i + 1
+					result["expired"] = expired
+					result["not_yet_valid"] = early
+					result["valid"] = i >= 0 && !expired && !early
+					if i < 0 || expired || early {
+						setExitCode(exitFailure)
+					}
+					emit(result)
+				}
+				if len(args) > 1 {
+					if keys, err := verify.ReadKeyFile(args[1]); err != nil {
+						fail(exitStorage, "Couldn't load public keys:", err)
+					} else {
+						check(keys)
+					}
 				} else {
-					fmt.Println("Grab token for", domain, "(y/n)?")
-					if r, _, _ := bufio.NewReader(os.Stdin).ReadRune(); r == 'y' || r == 'Y' {
-						if resp, err := user.PostForm("/get_account_token", url.Values{
-							"service_domain": []string{domain},
-						}); err != nil {
-							fmt.Println("Error encountered while contacting api for new token:", err)
-						} else if b, err := ioutil.ReadAll(resp.Body); err != nil {
-							fmt.Println("Error encountered while reading response body of api request:", err)
-						} else if rstr := strings.TrimSpace(string(b)); resp.StatusCode != 200 {
-							fmt.Println("The API rejected your request for a token and responded with the following:", rstr+".")
-						} else if err := clipboard.WriteAll(rstr); err != nil {
-							fmt.Println("Error encountered writing token to clipboard:", err)
+					withConfig(func(conf *Config) {
+						if keys, err := fetchPublicKeys(conf); err != nil {
+							fail(exitNetwork, "Couldn't grab the platform public keys:", err)
 						} else {
-							fmt.Println("Token copied to clipboard.")
+							check(keys)
 						}
+					}, func(err error) {
+						fail(exitStorage, "Couldn't grab config to find the platform public keys with:", err)
+					})
+				}
+			} else {
+				emit(result)
+			}
+		}
+	}
+	tokenInspectCmd := &cobra.Command{
+		Use:   "inspect [token|-]",
+		Short: "Decodes a UFKYC token (by default the one in your clipboard) and prints its claims",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   inspectToken,
+	}
+	tokenVerifyCmd := &cobra.Command{
+		Use:   "verify [token|-] [public key file]",
+		Short: "Like inspect, but also checks the token's signature against the platform public keys",
+		Args:  cobra.MaximumNArgs(2),
+		Run:   inspectToken,
+	}
+	var historyDomain, historyProfile, historySince, historyForget string
+	var historyLimit int
+	tokenHistoryCmd := &cobra.Command{
+		Use:   "history",
+		Short: "Lists the tokens grabbed from this machine (the domains, not the tokens)",
+		Long: `Lists the tokens grabbed from this machine, newest first: which domain, when,
+from which profile, and when they expire. The tokens themselves are never
+stored. --forget deletes every record of a domain.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var filter tokenHistoryFilter
+			var err error
+			if historyForget != "" && (historyDomain != "" || historyProfile != "" || historySince != "") {
+				fail(exitUsage, "--forget can't be combined with the other filters; it forgets the domain everywhere.")
+				return
+			} else if filter.Since, err = parseSince(historySince); err != nil {
+				fail(exitUsage, "Bad --since:", err)
+				return
+			}
+			for _, d := range []*string{&historyForget, &historyDomain} {
+				if *d == "" {
+					continue
+				} else if _, root, err := domainFromInput(*d); err != nil {
+					fail(exitUsage, "Bad domain:", err)
+					return
+				} else {
+					*d = root
+				}
+			}
+			filter.Domain, filter.Profile, filter.Limit = historyDomain, historyProfile, historyLimit
+			withDB(func(db *gorm.DB) {
+				if historyForget != "" {
+					if n, err := forgetTokenHistory(historyForget); err != nil {
+						fail(exitStorage, "Couldn't forget "+displayDomain(historyForget)+":", err)
+					} else {
+						fmt.Println("Forgot", n, "token(s) grabbed for "+displayDomain(historyForget)+".")
+						emit(map[string]interface{}{"domain": historyForget, "forgotten": n})
+					}
+				} else if issues, err := tokenHistory(filter); err != nil {
+					fail(exitStorage, "Couldn't read the token history:", err)
+				} else {
+					type entry struct {
+						Domain    string    `json:"domain"`
+						Profile   string    `json:"profile"`
+						Username  string    `json:"username"`
+						IssuedAt  time.Time `json:"issued_at"`
+						ExpiresAt time.Time `json:"expires_at"`
+					}
+					entries := []entry{}
+					if len(issues) == 0 {
+						fmt.Println("No tokens match.")
+					}
+					for _, i := range issues {
+						fmt.Println(i.CreatedAt.Local().Format("2006-01-02 15:04"), displayDomain(i.Domain), "- profile '"+i.Profile+"' as '"+i.Username+"', expires", describeTime(i.ExpiresAt))
+						entries = append(entries, entry{i.Domain, i.Profile, i.Username, i.CreatedAt, i.ExpiresAt})
+					}
+					emit(entries)
+				}
+			}, func(err error) {
+				fail(exitStorage, "Couldn't open the local database:", err)
+			})
+		},
+	}
+	tokenHistoryCmd.Flags().StringVar(&historyDomain, "domain", "", "Only show tokens for this domain")
+	tokenHistoryCmd.Flags().StringVar(&historyProfile, "profile-name", "", "Only show tokens grabbed from this profile")
+	tokenHistoryCmd.Flags().StringVar(&historySince, "since", "", "Only show tokens grabbed since a date (2006-01-02) or for a while back (7d, 12h)")
+	tokenHistoryCmd.Flags().IntVar(&historyLimit, "limit", 0, "Show at most this many tokens")
+	tokenHistoryCmd.Flags().StringVar(&historyForget, "forget", "", "Delete every record of tokens grabbed for this domain")
+	tokenHistoryCmd.RegisterFlagCompletionFunc("domain", completeHistoryDomains)
+	tokenHistoryCmd.RegisterFlagCompletionFunc("forget", completeHistoryDomains)
+	tokenHistoryCmd.RegisterFlagCompletionFunc("profile-name", completeProfiles)
+	tokenCmd.AddCommand(tokenInspectCmd, tokenVerifyCmd, tokenHistoryCmd)
+	var agentIdleTimeout time.Duration
+	var agentForeground bool
+	agentCmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Starts an agent that holds your API token so later commands don't have to unlock it",
+		Long: `Starts an agent that holds the current profile's API token, like ssh-agent does
+for keys. Start it with
+
+  eval "$(kycli agent)"
+
+and later kycli commands (and the browser's native host) will find it through
+$KYCLI_AGENT_SOCK and make their API requests through it, without asking for
+your credentials passphrase. After --idle-timeout without requests, or on
+` + "`kycli agent lock`" + `, the agent forgets the token until a kycli command unlocks the
+credential store again.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			sock := agentSocket()
+			if sock == "" {
+				sock = defaultAgentSocket()
+			}
+			//Stdout is for the shell to eval.
+			os.Stdout = os.Stderr
+			if _, err := agentCall(sock, agentRequest{Op: "status"}); err == nil {
+				fail(exitUsage, "An agent is already running at "+sock+".")
+				return
+			}
+			withUser(func(user *User) {
+				st := &agentState{Profile: conf.Name, Endpoint: conf.ApiEndpoint, Username: user.Name, UserID: user.ID, Token: user.ApiToken, Idle: agentIdleTimeout}
+				exports := func(pid int) {
+					if !structuredOutput() {
+						fmt.Fprintln(resultOut, "KYCLI_AGENT_SOCK='"+sock+"'; export KYCLI_AGENT_SOCK;")
+						fmt.Fprintln(resultOut, "echo Agent pid "+strconv.Itoa(pid)+";")
+					}
+					emit(map[string]interface{}{"socket": sock, "pid": pid, "profile": conf.Name})
+				}
+				if agentForeground {
+					if l, err := listenAgent(sock); err != nil {
+						fail(exitEnvironment, "Couldn't start the agent:", err)
+					} else {
+						exports(os.Getpid())
+						serveAgent(l, st)
 					}
+				} else if pid, err := startAgent(sock, st); err != nil {
+					fail(exitEnvironment, "Couldn't start the agent:", err)
+				} else {
+					exports(pid)
 				}
 			}, func(err error) {
-				fmt.Println("Couldn't grab UFKYC credentials to request token with:", err)
+				fail(exitAuth, "Couldn't unlock credentials for the agent:", err)
 			})
-		default:
-			fmt.Println("Command not recognized.")
-			printHelp()
+		},
+	}
+	agentCmd.PersistentFlags().StringVar(&agentSocketFlag, "socket", "", "The agent's socket (default $KYCLI_AGENT_SOCK, or one in $XDG_RUNTIME_DIR)")
+	agentCmd.Flags().DurationVar(&agentIdleTimeout, "idle-timeout", 15*time.Minute, "Lock after this long without requests (0 never locks)")
+	agentCmd.Flags().BoolVar(&agentForeground, "foreground", false, "Serve from this process instead of a detached one")
+	//withAgent runs f against the agent we were pointed at.
+	withAgent := func(op string, f func(sock string, resp agentResponse)) {
+		if sock := agentSocket(); sock == "" {
+			fail(exitUsage, "No agent to talk to; set $KYCLI_AGENT_SOCK or pass --socket.")
+		} else if resp, err := agentCall(sock, agentRequest{Op: op}); err != nil {
+			fail(exitEnvironment, "Couldn't talk to the agent:", err)
+		} else {
+			f(sock, resp)
 		}
 	}
+	describeAgent := func(sock string, resp agentResponse) {
+		if resp.Locked {
+			fmt.Println("The agent at " + sock + " serves the profile '" + resp.Profile + "' and is locked.")
+		} else {
+			fmt.Println("The agent at " + sock + " serves the profile '" + resp.Profile + "' and is unlocked as '" + resp.Username + "'.")
+		}
+		emit(map[string]interface{}{"socket": sock, "profile": resp.Profile, "username": resp.Username, "locked": resp.Locked})
+	}
+	agentStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Shows which profile the agent serves and whether it's locked",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withAgent("status", describeAgent)
+		},
+	}
+	agentLockCmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Makes the agent forget the API token until it's unlocked again",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withAgent("lock", describeAgent)
+		},
+	}
+	agentUnlockCmd := &cobra.Command{
+		Use:   "unlock",
+		Short: "Unlocks the credential store and hands the API token to the agent",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			//withUser gives a locked agent the token it unlocks.
+			withUser(func(user *User) {
+				withAgent("status", describeAgent)
+			}, func(err error) {
+				fail(exitAuth, "Couldn't unlock credentials for the agent:", err)
+			})
+		},
+	}
+	agentStopCmd := &cobra.Command{
+		Use:   "stop",
+		Short: "Stops the agent",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withAgent("stop", func(sock string, resp agentResponse) {
+				fmt.Println("Stopped the agent at " + sock + ".")
+				emit(map[string]interface{}{"ok": true, "socket": sock, "profile": resp.Profile})
+			})
+		},
+	}
+	agentCmd.AddCommand(agentStatusCmd, agentLockCmd, agentUnlockCmd, agentStopCmd)
+	nativeHostCmd := &cobra.Command{
+		Use:   "native-host",
+		Short: "Talks to the kycli browser extension over native messaging (started by the browser)",
+		Long: `Talks to the kycli browser extension over native messaging. The browser starts
+this itself once ` + "`kycli native-host install`" + ` has told it where to find us; the
+extension sends the active tab's origin, you confirm in a dialog (zenity or
+kdialog), and the token goes back to the extension. Any arguments are the
+ones browsers add, and are ignored.`,
+		//Browsers pass their own arguments, e.g. the calling extension's origin.
+		DisableFlagParsing: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 && (args[0] == "--help" || args[0] == "-h") {
+				cmd.Help()
+				return
+			}
+			//Stdout is the browser's; anything we'd normally print goes to
+			//stderr, which ends up in the browser's log.
+			out := os.Stdout
+			os.Stdout = os.Stderr
+			nonInteractive = true
+			if err := serveNativeHost(os.Stdin, out); err != nil {
+				fail(exitFailure, "Native messaging failed:", err)
+			}
+		},
+	}
+	var chromeExtensionIDs, firefoxExtensionIDs []string
+	nativeHostInstallCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Registers kycli as a native messaging host with the browsers in your home directory",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(chromeExtensionIDs)+len(firefoxExtensionIDs) == 0 {
+				fail(exitUsage, "Pass the extension to allow with --chrome-extension-id or --firefox-extension-id.")
+			} else if written, err := installNativeHost(chromeExtensionIDs, firefoxExtensionIDs); err != nil {
+				fail(exitStorage, "Couldn't install the native messaging host:", err)
+			} else if len(written) == 0 {
+				fail(exitEnvironment, "Didn't find any of those browsers in your home directory; start the browser once and try again.")
+			} else {
+				for _, path := range written {
+					fmt.Println("Wrote", path)
+				}
+				emit(map[string]interface{}{"manifests": written})
+			}
+		},
+	}
+	nativeHostInstallCmd.Flags().StringSliceVar(&chromeExtensionIDs, "chrome-extension-id", nil, "ID of the extension to allow in Chrome, Chromium and Brave (repeatable)")
+	nativeHostInstallCmd.Flags().StringSliceVar(&firefoxExtensionIDs, "firefox-extension-id", nil, "ID of the extension to allow in Firefox, e.g. kycli@unofficialkyc.com (repeatable)")
+	nativeHostUninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Removes the native messaging host manifests install wrote",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if removed, err := uninstallNativeHost(); err != nil {
+				fail(exitStorage, "Couldn't uninstall the native messaging host:", err)
+			} else {
+				for _, path := range removed {
+					fmt.Println("Removed", path)
+				}
+				if len(removed) == 0 {
+					fmt.Println("The native messaging host wasn't installed.")
+				}
+				emit(map[string]interface{}{"manifests": removed})
+			}
+		},
+	}
+	nativeHostCmd.AddCommand(nativeHostInstallCmd, nativeHostUninstallCmd)
+	completionCmd := &cobra.Command{
+		Use:   "completion (bash|zsh|fish)",
+		Short: "Prints a shell completion script",
+		Long: `Prints a shell completion script. To load it:
+  bash: source <(kycli completion bash)
+  zsh:  kycli completion zsh > "${fpath[1]}/_kycli"
+  fish: kycli completion fish | source`,
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			switch args[0] {
+			case "bash":
+				err = root.GenBashCompletion(resultOut)
+			case "zsh":
+				err = root.GenZshCompletion(resultOut)
+			case "fish":
+				err = root.GenFishCompletion(resultOut, true)
+			}
+			if err != nil {
+				fail(exitFailure, "Couldn't generate the completion script:", err)
+			}
+		},
+	}
+
+	root.AddCommand(whoamiCmd, apiSwitchCmd, profileCmd, credentialsCmd, logoutCmd, sessionsCmd, registerCmd, donateCmd, serviceCmd, devserverCmd, pslCmd, clearCmd, tokenCmd, agentCmd, nativeHostCmd, completionCmd, clearClipboardCmd, agentDaemonCmd)
+	if cmd, err := root.ExecuteC(); err != nil {
+		fail(exitUsage, cmd.CommandPath()+":", err)
+		cmd.Usage()
+	}
+	os.Exit(exitCode)
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//`kycli native-host` is started by the browser on behalf of an extension and
+//speaks the native messaging protocol: every message, both ways, is a JSON
+//object preceded by its length as a 32 bit integer in little-endian order. The
+//extension sends the active tab's origin, we ask the user (in a dialog, since
+//stdin and stdout belong to the browser) and answer with a token.
+
+const nativeHostName = "com.unofficialkyc.kycli"
+
+// Browsers won't send us more than 4GB, and won't take more than 1MB back.
+// Nothing we exchange comes close, so anything bigger is a broken stream.
+const maxNativeMessage = 1024 * 1024
+
+type nativeRequest struct {
+	// ID is echoed back, so an extension can match up answers.
+	ID     string `json:"id,omitempty"`
+	Origin string `json:"origin"`
+}
+
+type nativeError struct {
+	Kind    string `json:"kind"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type nativeResponse struct {
+	ID     string       `json:"id,omitempty"`
+	Domain string       `json:"domain,omitempty"`
+	Site   string       `json:"site,omitempty"`
+	Token  string       `json:"token,omitempty"`
+	Error  *nativeError `json:"error,omitempty"`
+}
+
+func readNativeMessage(r io.Reader, v interface{}) error {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err == io.EOF {
+		return err
+	} else if err != nil {
+		return errors.Wrap(err, "error reading message length")
+	} else if length > maxNativeMessage {
+		return errors.Errorf("message of %d bytes is too big", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return errors.Wrap(err, "error reading message")
+	} else if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrap(err, "message isn't valid json")
+	}
+	return nil
+}
+
+func writeNativeMessage(w io.Writer, v interface{}) error {
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrap(err, "error marshaling message")
+	} else if len(b) > maxNativeMessage {
+		return errors.Errorf("message of %d bytes is too big", len(b))
+	} else if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return errors.Wrap(err, "error writing message length")
+	} else if _, err := w.Write(b); err != nil {
+		return errors.Wrap(err, "error writing message")
+	}
+	return nil
+}
+
+// serveNativeHost answers requests from in on out until the browser hangs up.
+func serveNativeHost(in io.Reader, out io.Writer) error {
+	for {
+		var req nativeRequest
+		if err := readNativeMessage(in, &req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := writeNativeMessage(out, handleNativeRequest(req)); err != nil {
+			return err
+		}
+	}
+}
+
+func nativeFailure(resp nativeResponse, code int, err error) nativeResponse {
+	if tagged, ok := errors.Cause(err).(exitError); ok {
+		code = tagged.code
+	}
+	resp.Error = &nativeError{Kind: exitKinds[code], Code: code, Message: err.Error()}
+	return resp
+}
+
+func handleNativeRequest(req nativeRequest) nativeResponse {
+	resp := nativeResponse{ID: req.ID}
+	host, domain, err := domainFromInput(req.Origin)
+	if err != nil {
+		return nativeFailure(resp, exitUsage, err)
+	}
+	resp.Site, resp.Domain = host, domain
+	withUser(func(user *User) {
+		if ok, err := guiConfirmToken(host, domain, lookalikeWarnings(domain, knownDomains(user))); err != nil {
+			resp = nativeFailure(resp, exitEnvironment, err)
+		} else if !ok {
+			resp = nativeFailure(resp, exitFailure, errors.New("the user declined"))
+		} else if token, err := grabToken(user, domain); err != nil {
+			resp = nativeFailure(resp, exitAPI, err)
+		} else {
+			resp.Token = token
+		}
+	}, func(err error) {
+		resp = nativeFailure(resp, exitAuth, err)
+	})
+	return resp
+}
+
+// guiConfirmToken is confirmTokenDomain and confirmLookalike for when we
+// can't use the terminal.
+func guiConfirmToken(host string, domain string, warnings []string) (bool, error) {
+	question := "Grab a UFKYC token for " + displayDomain(domain) + "?"
+	if host != domain {
+		question += "\n\nThe page is on " + displayDomain(host) + "; the token works for all of " + displayDomain(domain) + "."
+	}
+	if len(warnings) == 0 {
+		return guiQuestion(question)
+	}
+	text := "WARNING: " + displayDomain(domain) + " looks like it could be impersonating another site!\n"
+	for _, w := range warnings {
+		text += "\n - " + w
+	}
+	text += "\n\nIf you didn't expect this, close the page: you're probably being phished.\nType " + domain + " to grab a token for it anyway."
+	if typed, err := guiEntry(text); err != nil {
+		return false, err
+	} else {
+		return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(typed)), ".") == domain, nil
+	}
+}
+
+// guiTool finds something to draw dialogs with.
+func guiTool() (string, error) {
+	for _, tool := range []string{"zenity", "kdialog"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			return tool, nil
+		}
+	}
+	return "", withExitCode(exitEnvironment, errors.New("neither zenity nor kdialog is installed, so there's no way to ask you to confirm"))
+}
+
+// runDialog runs a dialog, treating the user cancelling it as an answer
+// rather than an error.
+func runDialog(tool string, args ...string) (string, bool, error) {
+	out, err := exec.Command(tool, args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, withExitCode(exitEnvironment, errors.Wrap(err, "error running "+tool))
+	}
+	return strings.TrimRight(string(out), "\n"), true, nil
+}
+
+func guiQuestion(text string) (bool, error) {
+	tool, err := guiTool()
+	if err != nil {
+		return false, err
+	} else if tool == "zenity" {
+		_, ok, err := runDialog(tool, "--question", "--title=kycli", "--text="+html.EscapeString(text))
+		return ok, err
+	}
+	_, ok, err := runDialog(tool, "--title", "kycli", "--yesno", text)
+	return ok, err
+}
+
+func guiEntry(text string) (string, error) {
+	tool, err := guiTool()
+	if err != nil {
+		return "", err
+	} else if tool == "zenity" {
+		out, _, err := runDialog(tool, "--entry", "--title=kycli", "--text="+html.EscapeString(text))
+		return out, err
+	}
+	out, _, err := runDialog(tool, "--title", "kycli", "--inputbox", text)
+	return out, err
+}
+
+// nativeHostDirs are where Chrome, Chromium, Brave and Firefox look for host
+// manifests, relative to the home directory. A browser is only set up if its own directory (the
+// first part) exists.
+var nativeHostDirs = []struct {
+	firefox  bool
+	base     string
+	manifest string
+}{
+	{false, ".config/google-chrome", "NativeMessagingHosts"},
+	{false, ".config/chromium", "NativeMessagingHosts"},
+	{false, ".config/BraveSoftware/Brave-Browser", "NativeMessagingHosts"},
+	{true, ".mozilla", "native-messaging-hosts"},
+}
+
+type nativeHostManifest struct {
+	Name              string   `json:"name"`
+	Description       string   `json:"description"`
+	Path              string   `json:"path"`
+	Type              string   `json:"type"`
+	AllowedOrigins    []string `json:"allowed_origins,omitempty"`
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+}
+
+// nativeHostWrapper is the script manifests point at. Browsers start the host
+// with arguments of their own (Chrome the caller's origin, Firefox the
+// manifest's path and the extension's ID), which kycli alone would take for
+// a subcommand.
+func nativeHostWrapper(self string) string {
+	return "#!/bin/sh\nexec '" + strings.Replace(self, "'", `'\''`, -1) + "' native-host \"$@\"\n"
+}
+
+// installNativeHost writes manifests, and the wrapper they start, for every
+// browser we find that we were given an extension ID for, returning the
+// paths written.
+func installNativeHost(chromeIDs []string, firefoxIDs []string) ([]string, error) {
+	w := exitWrapper(exitStorage, "error installing native messaging host")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, w(withExitCode(exitEnvironment, err))
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, w(withExitCode(exitEnvironment, err))
+	} else if self, err = filepath.EvalSymlinks(self); err != nil {
+		return nil, w(withExitCode(exitEnvironment, err))
+	}
+	var written []string
+	for _, d := range nativeHostDirs {
+		dir := filepath.Join(home, d.base, d.manifest)
+		path := filepath.Join(dir, nativeHostName+".json")
+		wrapper := filepath.Join(dir, nativeHostName+".sh")
+		manifest := nativeHostManifest{Name: nativeHostName, Description: "UFKYC tokens from kycli", Path: wrapper, Type: "stdio"}
+		if d.firefox {
+			manifest.AllowedExtensions = firefoxIDs
+		} else {
+			for _, id := range chromeIDs {
+				manifest.AllowedOrigins = append(manifest.AllowedOrigins, "chrome-extension://"+id+"/")
+			}
+		}
+		if len(manifest.AllowedOrigins)+len(manifest.AllowedExtensions) == 0 {
+			continue
+		} else if _, err := os.Stat(filepath.Join(home, d.base)); os.IsNotExist(err) {
+			continue
+		} else if b, err := json.MarshalIndent(manifest, "", "  "); err != nil {
+			return written, w(err)
+		} else if err := os.MkdirAll(dir, 0755); err != nil {
+			return written, w(err)
+		} else if err := ioutil.WriteFile(wrapper, []byte(nativeHostWrapper(self)), 0755); err != nil {
+			return written, w(err)
+		} else if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+			return written, w(err)
+		}
+		written = append(written, wrapper, path)
+	}
+	return written, nil
+}
+
+// uninstallNativeHost removes every manifest and wrapper installNativeHost
+// could have written, returning the paths removed.
+func uninstallNativeHost() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, withExitCode(exitEnvironment, err)
+	}
+	var removed []string
+	for _, d := range nativeHostDirs {
+		for _, ext := range []string{".json", ".sh"} {
+			path := filepath.Join(home, d.base, d.manifest, nativeHostName+ext)
+			if err := os.Remove(path); err == nil {
+				removed = append(removed, path)
+			} else if !os.IsNotExist(err) {
+				return removed, withExitCode(exitStorage, errors.Wrap(err, "error removing "+path))
+			}
+		}
+	}
+	return removed, nil
+}
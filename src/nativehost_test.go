@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNativeMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	sent := []nativeRequest{{ID: "1", Origin: "https://example.com"}, {Origin: "https://bücher.de/x?y"}}
+	for _, req := range sent {
+		if err := writeNativeMessage(&buf, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := binary.LittleEndian.Uint32(buf.Bytes()); got != uint32(len(`{"id":"1","origin":"https://example.com"}`)) {
+		t.Errorf("first length prefix is %d", got)
+	}
+	for _, want := range sent {
+		var got nativeRequest
+		if err := readNativeMessage(&buf, &got); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("read %+v, want %+v", got, want)
+		}
+	}
+	var req nativeRequest
+	if err := readNativeMessage(&buf, &req); err != io.EOF {
+		t.Errorf("reading past the last message gave %v, want io.EOF", err)
+	}
+}
+
+func TestReadNativeMessageErrors(t *testing.T) {
+	frame := func(length uint32, body string) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, length)
+		return append(b, body...)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"short length", []byte{1, 0}},
+		{"too big", frame(maxNativeMessage+1, "")},
+		{"truncated", frame(10, `{"id":`)},
+		{"not json", frame(5, "hello")},
+	}
+	for _, tt := range tests {
+		var req nativeRequest
+		if err := readNativeMessage(bytes.NewReader(tt.in), &req); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, want an error", tt.name, err)
+		}
+	}
+}
+
+func TestWriteNativeMessageTooBig(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeNativeMessage(&buf, strings.Repeat("x", maxNativeMessage)); err == nil {
+		t.Error("wrote a message over the limit")
+	} else if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes of a message over the limit", buf.Len())
+	}
+}
+
+func TestServeNativeHost(t *testing.T) {
+	//Origins that aren't sites are answered without touching the profile.
+	var in, out bytes.Buffer
+	for _, req := range []nativeRequest{{ID: "a", Origin: "not a site"}, {ID: "b", Origin: "https://127.0.0.1/"}} {
+		if err := writeNativeMessage(&in, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := serveNativeHost(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		var resp nativeResponse
+		if err := readNativeMessage(&out, &resp); err != nil {
+			t.Fatal(err)
+		} else if resp.ID != id {
+			t.Errorf("answer has ID %q, want %q", resp.ID, id)
+		} else if resp.Token != "" || resp.Error == nil || resp.Error.Code != exitUsage {
+			t.Errorf("answer to %s is %+v, want a usage error", id, resp)
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("%d bytes left over after the answers", out.Len())
+	}
+	if err := serveNativeHost(bytes.NewReader([]byte{9, 0, 0, 0, '{'}), &out); err == nil {
+		t.Error("a broken stream didn't stop serveNativeHost")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+//With --output json or yaml, everything we'd normally say to a human is moved
+//to stderr, and stdout gets exactly one object describing the command's
+//result: whatever it passed to emit, or the error it passed to fail.
+
+var outputFormat = "text"
+
+// resultOut is the real stdout once setupOutput has pointed os.Stdout at
+// stderr.
+var resultOut = os.Stdout
+
+var emitted bool
+
+func setupOutput() error {
+	switch outputFormat {
+	case "text":
+	case "json", "yaml":
+		os.Stdout = os.Stderr
+	default:
+		format := outputFormat
+		outputFormat = "text"
+		return errors.New("unknown output format '" + format + "'; use text, json or yaml")
+	}
+	return nil
+}
+
+func structuredOutput() bool {
+	return outputFormat != "text"
+}
+
+// emit writes a command's result object. In text mode the command has
+// already said everything in prose, so nothing happens.
+func emit(v interface{}) {
+	if !structuredOutput() || emitted {
+		return
+	}
+	emitted = true
+	//Going through json keeps the field names identical in both formats.
+	var generic interface{}
+	if b, err := json.Marshal(v); err != nil {
+		fmt.Fprintln(os.Stderr, "error marshaling result:", err)
+	} else if err := json.Unmarshal(b, &generic); err != nil {
+		fmt.Fprintln(os.Stderr, "error marshaling result:", err)
+	} else if outputFormat == "json" {
+		enc := json.NewEncoder(resultOut)
+		enc.SetIndent("", "  ")
+		enc.Encode(generic)
+	} else if b, err := yaml.Marshal(generic); err != nil {
+		fmt.Fprintln(os.Stderr, "error marshaling result:", err)
+	} else {
+		resultOut.Write(b)
+	}
+}
+
+// Exit codes, so scripts can tell what kind of thing went wrong. These are
+// documented in the root command's help and the README; don't renumber them.
+const (
+	exitOK          = 0
+	exitFailure     = 1 //anything not covered below, e.g. a token failing `token verify`
+	exitUsage       = 2 //bad arguments, or input we needed and didn't get
+	exitAuth        = 3 //not logged in, bad credentials, or the API refused our token
+	exitNetwork     = 4 //couldn't talk to the API
+	exitAPI         = 5 //the API answered, but rejected the request
+	exitStorage     = 6 //the local database or credential store
+	exitEnvironment = 7 //no clipboard, missing environment variables and such
+)
+
+var exitKinds = map[int]string{
+	exitFailure:     "failure",
+	exitUsage:       "usage",
+	exitAuth:        "auth",
+	exitNetwork:     "network",
+	exitAPI:         "api",
+	exitStorage:     "storage",
+	exitEnvironment: "environment",
+}
+
+// exitCode is what main exits with; the first failure decides it.
+var exitCode = exitOK
+
+func setExitCode(code int) {
+	if exitCode == exitOK {
+		exitCode = code
+	}
+}
+
+// exitError tags an error with the exit code it should cause, however far up
+// it gets wrapped.
+type exitError struct {
+	error
+	code int
+}
+
+// withExitCode tags err with code, unless something closer to the problem
+// already tagged it.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	} else if _, ok := errors.Cause(err).(exitError); ok {
+		return err
+	}
+	return exitError{error: err, code: code}
+}
+
+// exitWrapper is errWrapper for errors that should cause code.
+func exitWrapper(code int, outerPrefix string) ErrWrapFunc {
+	w := errWrapper(outerPrefix)
+	return func(err error, prefixes ...string) error {
+		return w(withExitCode(code, err), prefixes...)
+	}
+}
+
+// apiFailure picks the exit code for a non-200 API response.
+func apiFailure(status int) int {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return exitAuth
+	}
+	return exitAPI
+}
+
+type errorResult struct {
+	Error struct {
+		Kind    string `json:"kind"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// fail prints a failure to stderr and makes it the command's result. code is
+// the exit code to use unless one of a's errors was tagged with a more
+// specific one.
+func fail(code int, a ...interface{}) {
+	for _, v := range a {
+		if err, ok := v.(error); ok {
+			if tagged, ok := errors.Cause(err).(exitError); ok {
+				code = tagged.code
+			}
+		}
+	}
+	setExitCode(code)
+	msg := fmt.Sprintln(a...)
+	fmt.Fprint(os.Stderr, msg)
+	var res errorResult
+	res.Error.Kind = exitKinds[code]
+	res.Error.Code = code
+	res.Error.Message = msg[:len(msg)-1]
+	emit(res)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+//Each Config row is a named profile with its own API endpoint and passport.
+//Commands act on the profile picked by --profile, then $KYCLI_PROFILE, then
+//whichever one `kycli profile use` marked current.
+
+const defaultApiEndpoint = "https://unofficialkyc.com/api/v1"
+const defaultProfileName = "default"
+
+var validProfileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// profileFlag is set by the global --profile flag.
+var profileFlag string
+
+func requestedProfile() string {
+	if profileFlag != "" {
+		return profileFlag
+	}
+	return os.Getenv("KYCLI_PROFILE")
+}
+
+// withProfiles grabs every profile, naming the ones that were made before
+// profiles existed.
+func withProfiles(f func(profiles []Config), e func(err error)) {
+	w := errWrapper("error getting profiles from db")
+	withDB(func(db *gorm.DB) {
+		var profiles []Config
+		if err := db.Preload("User").Order("id").Find(&profiles).Error; err != nil {
+			e(w(err))
+			return
+		}
+		for i := range profiles {
+			if profiles[i].Name == "" {
+				profiles[i].Name = defaultProfileName
+				if i > 0 {
+					profiles[i].Name = "profile-" + strconv.Itoa(int(profiles[i].ID))
+				}
+				if err := db.Model(&profiles[i]).Update("name", profiles[i].Name).Error; err != nil {
+					e(w(err, "error naming old config"))
+					return
+				}
+			}
+		}
+		f(profiles)
+	}, func(err error) {
+		e(w(err))
+	})
+}
+
+func findProfile(profiles []Config, name string) *Config {
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+// selectProfile picks the profile commands should act on out of profiles,
+// returning nil if the default one needs to be created.
+func selectProfile(profiles []Config) (*Config, error) {
+	if name := requestedProfile(); name != "" {
+		if p := findProfile(profiles, name); p != nil {
+			return p, nil
+		} else if name != defaultProfileName {
+			return nil, withExitCode(exitUsage, errors.New("there's no profile named '"+name+"'; add it with `kycli profile add "+name+"`"))
+		}
+		return nil, nil
+	}
+	for i := range profiles {
+		if profiles[i].Current {
+			return &profiles[i], nil
+		}
+	}
+	if p := findProfile(profiles, defaultProfileName); p != nil {
+		return p, nil
+	} else if len(profiles) == 1 {
+		return &profiles[0], nil
+	} else if len(profiles) > 1 {
+		return nil, withExitCode(exitUsage, errors.New("you have several profiles and none of them is current; pick one with `kycli profile use`"))
+	}
+	return nil, nil
+}
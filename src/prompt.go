@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+//Everything kycli asks the user goes through here, so that --non-interactive
+//can make a missing answer an error instead of a hang, and scripts can supply
+//the answers through flags, the environment, or stdin.
+
+var (
+	nonInteractive   bool
+	assumeYes        bool
+	passwordStdin    bool
+	usernameFlag     string
+	passwordFileFlag string
+)
+
+// errNeedsInput builds the error returned when --non-interactive is set and
+// nothing provided what we would have asked for.
+func errNeedsInput(what string, sources string) error {
+	return withExitCode(exitUsage, errors.New("--non-interactive was passed, but no "+what+" was given; provide it with "+sources))
+}
+
+// readLine reads one line from stdin a byte at a time, so nothing after it is
+// swallowed by buffering.
+func readLine() (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(b); n == 1 && b[0] != '\n' {
+			line = append(line, b[0])
+		} else if n == 1 || (err == io.EOF && len(line) > 0) {
+			return strings.TrimRight(string(line), "\r"), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// promptLine asks for a line of input, or fails if we can't ask.
+func promptLine(label string, what string, sources string) (string, error) {
+	if nonInteractive {
+		return "", errNeedsInput(what, sources)
+	}
+	fmt.Print(label)
+	if line, err := readLine(); err != nil {
+		return "", errors.Wrap(err, "error reading "+what+" from stdin")
+	} else {
+		return strings.TrimSpace(line), nil
+	}
+}
+
+func promptUsername() (string, error) {
+	if usernameFlag != "" {
+		return usernameFlag, nil
+	} else if u := os.Getenv("KYCLI_USERNAME"); u != "" {
+		return u, nil
+	}
+	return promptLine("Username: ", "username", "--username or $KYCLI_USERNAME")
+}
+
+func readPasswordFile(path string) (string, error) {
+	if b, err := ioutil.ReadFile(path); err != nil {
+		return "", errors.Wrap(err, "error reading password file")
+	} else {
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+}
+
+// promptPassword grabs a password from --password-file, $KYCLI_PASSWORD_FILE
+// or --password-stdin, and otherwise asks for it on the terminal, twice if
+// confirm is set.
+func promptPassword(confirm bool) (string, error) {
+	if passwordFileFlag != "" {
+		return readPasswordFile(passwordFileFlag)
+	} else if path := os.Getenv("KYCLI_PASSWORD_FILE"); path != "" {
+		return readPasswordFile(path)
+	} else if passwordStdin {
+		return readLine()
+	} else if nonInteractive {
+		return "", errNeedsInput("password", "--password-file, $KYCLI_PASSWORD_FILE or --password-stdin")
+	} else if !terminal.IsTerminal(int(syscall.Stdin)) {
+		return "", errors.New("stdin is not a terminal, so we can't ask for a password; use --password-file, $KYCLI_PASSWORD_FILE or --password-stdin")
+	}
+	for {
+		fmt.Print("Password: ")
+		if password, err := secureTermRead(); err != nil {
+			return "", errors.Wrap(err, "error reading password from terminal")
+		} else if !confirm {
+			return password, nil
+		} else {
+			fmt.Print("Confirm password: ")
+			if confirmation, err := secureTermRead(); err != nil {
+				return "", errors.Wrap(err, "error reading password from terminal")
+			} else if password == confirmation {
+				return password, nil
+			}
+			fmt.Println("Passwords were not the same, try again: ")
+		}
+	}
+}
+
+// confirm asks a yes/no question. --yes answers it, and --non-interactive
+// without --yes refuses to guess.
+func confirm(question string) (bool, error) {
+	fmt.Println(question, "(y/n)?")
+	if assumeYes {
+		fmt.Println("y (--yes)")
+		return true, nil
+	} else if nonInteractive {
+		return false, withExitCode(exitUsage, errors.New("--non-interactive was passed, but this needs confirmation; pass --yes to confirm"))
+	} else if line, err := readLine(); err != nil {
+		return false, errors.Wrap(err, "error reading confirmation from stdin")
+	} else {
+		line = strings.TrimSpace(line)
+		return strings.HasPrefix(line, "y") || strings.HasPrefix(line, "Y"), nil
+	}
+}
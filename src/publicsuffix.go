@@ -0,0 +1,239 @@
+package main
+
+import (
+	_ "embed"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+//Tokens are requested for registrable domains (eTLD+1), the part of a name
+//someone can actually buy: example.com, example.co.uk, someone.github.io. We
+//find them with the Public Suffix List. A snapshot is built in, and `kycli
+//psl refresh` can swap in a newer copy, which is kept next to the database.
+
+//go:embed public_suffix_list.dat
+var bundledPublicSuffixList []byte
+
+const publicSuffixListFile = "public_suffix_list.dat"
+
+type publicSuffixList struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+	// Source is "bundled" or the path of the refreshed copy.
+	Source string
+}
+
+// parsePublicSuffixList reads the list's text format. Rules are stored in
+// their punycode form, since that's what we compare against.
+func parsePublicSuffixList(b []byte) (*publicSuffixList, error) {
+	list := &publicSuffixList{rules: map[string]bool{}, wildcards: map[string]bool{}, exceptions: map[string]bool{}}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		} else if rule := fields[0]; strings.HasPrefix(rule, "!") {
+			if ascii, err := idna.ToASCII(rule[1:]); err == nil {
+				list.exceptions[strings.ToLower(ascii)] = true
+			}
+		} else if strings.HasPrefix(rule, "*.") {
+			if ascii, err := idna.ToASCII(rule[2:]); err == nil {
+				list.wildcards[strings.ToLower(ascii)] = true
+			}
+		} else if ascii, err := idna.ToASCII(rule); err == nil {
+			list.rules[strings.ToLower(ascii)] = true
+		}
+	}
+	if len(list.rules) < 1000 || !list.rules["com"] {
+		return nil, errors.New("that doesn't look like the public suffix list")
+	}
+	return list, nil
+}
+
+// Len is the number of rules in the list.
+func (l *publicSuffixList) Len() int {
+	return len(l.rules) + len(l.wildcards) + len(l.exceptions)
+}
+
+// suffixLabels is how many of labels make up the public suffix.
+func (l *publicSuffixList) suffixLabels(labels []string) int {
+	//Walk from the longest candidate to the shortest; the first match is the
+	//longest rule, and exceptions beat wildcards.
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		if l.exceptions[name] {
+			return len(labels) - i - 1
+		} else if l.rules[name] {
+			return len(labels) - i
+		} else if i+1 < len(labels) && l.wildcards[strings.Join(labels[i+1:], ".")] {
+			return len(labels) - i
+		}
+	}
+	//The implicit "*" rule: an unlisted TLD is a public suffix.
+	return 1
+}
+
+var loadedPublicSuffixList *publicSuffixList
+
+func publicSuffixListPath() (string, error) {
+	var path string
+	var pathErr error
+	withDBPath(func(string) {
+		path = dbpath + publicSuffixListFile
+	}, func(err error) {
+		pathErr = err
+	})
+	return path, pathErr
+}
+
+// publicSuffixes grabs the refreshed list if there is one, or the bundled
+// snapshot otherwise.
+func publicSuffixes() *publicSuffixList {
+	if loadedPublicSuffixList == nil {
+		if path, err := publicSuffixListPath(); err == nil {
+			if b, err := ioutil.ReadFile(path); err == nil {
+				if list, err := parsePublicSuffixList(b); err == nil {
+					list.Source = path
+					loadedPublicSuffixList = list
+					return list
+				}
+			}
+		}
+		list, err := parsePublicSuffixList(bundledPublicSuffixList)
+		if err != nil {
+			panic("bundled public suffix list is broken: " + err.Error())
+		}
+		list.Source = "bundled"
+		loadedPublicSuffixList = list
+	}
+	return loadedPublicSuffixList
+}
+
+// domainPattern matches punycode domains with at least two labels. ozzo's
+// is.Domain would do, except it turns away IDN top level domains like
+// xn--p1ai.
+var domainPattern = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// normalizeDomain lowercases name and converts it to punycode.
+func normalizeDomain(name string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if ascii, err := idna.Lookup.ToASCII(name); err != nil {
+		return "", errors.Wrap(err, "'"+name+"' is not a valid domain")
+	} else if ascii = strings.ToLower(ascii); !domainPattern.MatchString(ascii) || len(ascii) > 253 {
+		return "", errors.New("'" + name + "' is not a valid domain")
+	} else {
+		return ascii, nil
+	}
+}
+
+// registrableDomain reduces name to the registrable domain it belongs to, in
+// punycode.
+func registrableDomain(name string) (string, error) {
+	ascii, err := normalizeDomain(name)
+	if err != nil {
+		return "", err
+	}
+	labels := strings.Split(ascii, ".")
+	n := publicSuffixes().suffixLabels(labels)
+	if n >= len(labels) {
+		return "", errors.New("'" + name + "' is a public suffix, which nobody can own; use the domain registered under it")
+	}
+	return strings.Join(labels[len(labels)-n-1:], "."), nil
+}
+
+// rootDomain checks name is itself a registrable domain rather than a
+// subdomain of one, returning its punycode form.
+func rootDomain(name string) (string, error) {
+	if root, err := registrableDomain(name); err != nil {
+		return "", err
+	} else if ascii, _ := normalizeDomain(name); ascii != root {
+		return "", errors.New("'" + name + "' is not a root domain; the domain registered is '" + displayDomain(root) + "'")
+	} else {
+		return root, nil
+	}
+}
+
+// hostFromInput pulls the hostname out of whatever people copy from an
+// address bar: a bare domain, a URL, host:port or user@host.
+func hostFromInput(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", errors.New("nothing was given")
+	} else if strings.ContainsAny(input, " \t\r\n") {
+		return "", errors.New("'" + input + "' is not a domain or URL")
+	}
+	raw := input
+	if !strings.Contains(raw, "://") {
+		raw = "//" + raw
+	}
+	if u, err := url.Parse(raw); err != nil {
+		return "", errors.New("'" + input + "' is not a domain or URL")
+	} else if host := u.Hostname(); host == "" {
+		return "", errors.New("'" + input + "' has no host in it")
+	} else if net.ParseIP(host) != nil {
+		return "", errors.New("'" + host + "' is an IP address; tokens are only for domains")
+	} else {
+		return host, nil
+	}
+}
+
+// domainFromInput finds the host in input and the registrable domain it
+// belongs to, both in punycode.
+func domainFromInput(input string) (host string, root string, err error) {
+	if h, err := hostFromInput(input); err != nil {
+		return "", "", err
+	} else if host, err = normalizeDomain(h); err != nil {
+		return "", "", err
+	} else if root, err = registrableDomain(host); err != nil {
+		return "", "", err
+	}
+	return host, root, nil
+}
+
+// displayDomain shows a punycode domain as people read it, keeping the
+// punycode alongside when they differ.
+func displayDomain(ascii string) string {
+	if unicode, err := idna.ToUnicode(ascii); err == nil && unicode != ascii {
+		return unicode + " (" + ascii + ")"
+	}
+	return ascii
+}
+
+// refreshPublicSuffixList replaces the list we use with the one in path.
+func refreshPublicSuffixList(path string) (*publicSuffixList, error) {
+	w := exitWrapper(exitStorage, "error refreshing public suffix list")
+	if b, err := ioutil.ReadFile(path); err != nil {
+		return nil, w(err)
+	} else if list, err := parsePublicSuffixList(b); err != nil {
+		return nil, w(withExitCode(exitUsage, err))
+	} else if dest, err := publicSuffixListPath(); err != nil {
+		return nil, w(err)
+	} else if err := os.MkdirAll(dbpath, 0700); err != nil {
+		return nil, w(err)
+	} else if err := ioutil.WriteFile(dest+".tmp", b, 0600); err != nil {
+		return nil, w(err)
+	} else if err := os.Rename(dest+".tmp", dest); err != nil {
+		return nil, w(err)
+	} else {
+		list.Source = dest
+		loadedPublicSuffixList = list
+		return list, nil
+	}
+}
+
+// resetPublicSuffixList goes back to the bundled snapshot.
+func resetPublicSuffixList() error {
+	if path, err := publicSuffixListPath(); err != nil {
+		return withExitCode(exitStorage, err)
+	} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return withExitCode(exitStorage, errors.Wrap(err, "error removing refreshed public suffix list"))
+	}
+	loadedPublicSuffixList = nil
+	return nil
+}
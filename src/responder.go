@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//`register_domain --serve` and `--webroot` answer the path challenge for the
+//operator until the domain validates or its window runs out, the way certbot's
+//standalone and webroot modes do for ACME.
+
+// challengeInterval is how often we ask the API whether the domain validated
+// while answering its challenge.
+const challengeInterval = 15 * time.Second
+
+var errInterrupted = errors.New("interrupted")
+
+// listenChallenge listens on addr for serveChallenge.
+func listenChallenge(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if errors.Is(err, os.ErrPermission) {
+		return nil, withExitCode(exitEnvironment, errors.Wrap(err, "not allowed to listen on "+addr+"; ports below 1024 need root (or CAP_NET_BIND_SERVICE), or forward port 80 to a higher one and serve there"))
+	} else if err != nil {
+		return nil, withExitCode(exitEnvironment, errors.Wrap(err, "error listening on "+addr))
+	}
+	return l, nil
+}
+
+// serveChallenge answers challenge.Path with challenge.Content on addr, and
+// 404s everything else. The returned func stops the server.
+func serveChallenge(addr string, challenge domainChallenge) (func(), error) {
+	l, err := listenChallenge(addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != challenge.Path || r.Method != "GET" && r.Method != "HEAD" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Println("Answered the challenge for " + r.RemoteAddr + ".")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(challenge.Content))
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(l)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
+
+// writeWebroot puts the challenge file into the document root dir. The
+// returned func removes it again, along with any directories we had to make.
+func writeWebroot(dir string, challenge domainChallenge) (func(), error) {
+	w := exitWrapper(exitStorage, "error writing challenge file into "+dir)
+	dir = filepath.Clean(dir)
+	//The path comes from the API, but it still shouldn't get out of dir.
+	rel := path.Clean("/" + challenge.Path)
+	if rel == "/" || rel != challenge.Path {
+		return nil, w(errors.New("refusing to write to the odd path '" + challenge.Path + "'"))
+	} else if info, err := os.Stat(dir); err != nil {
+		return nil, w(err)
+	} else if !info.IsDir() {
+		return nil, w(errors.New("it isn't a directory"))
+	}
+	file := filepath.Join(dir, filepath.FromSlash(rel))
+	var made []string
+	for d := filepath.Dir(file); d != dir; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); os.IsNotExist(err) {
+			made = append([]string{d}, made...)
+		}
+	}
+	cleanup := func() {
+		os.Remove(file)
+		for i := len(made) - 1; i >= 0; i-- {
+			os.Remove(made[i])
+		}
+	}
+	for _, d := range made {
+		if err := os.Mkdir(d, 0755); err != nil {
+			cleanup()
+			return nil, w(err)
+		}
+	}
+	if err := ioutil.WriteFile(file, []byte(challenge.Content), 0644); err != nil {
+		cleanup()
+		return nil, w(err)
+	}
+	return cleanup, nil
+}
+
+// awaitValidation polls the API until domain is no longer pending, returning
+// errInterrupted if the user gives up first. Like `status --wait`, it retries
+// failed checks until the domain's window would have run out.
+func awaitValidation(user *User, domain string) (domainStatus, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	var deadline time.Time
+	for {
+		statuses, err := fetchDomainStatus(user, domain)
+		if err != nil && time.Now().Before(deadline) {
+			fmt.Fprintln(os.Stderr, "Couldn't check on the domain; trying again:", err)
+		} else if err != nil {
+			return domainStatus{}, err
+		}
+		for _, d := range statuses {
+			if d.Domain == domain && d.State != "pending" {
+				return d, nil
+			} else if d.Domain == domain {
+				deadline = d.ExpiresAt
+			}
+		}
+		select {
+		case <-signals:
+			return domainStatus{}, errInterrupted
+		case <-time.After(challengeInterval):
+		}
+	}
+}
+
+// responderOptions are register_domain's flags for answering a challenge
+// itself. At most one of them should be given.
+type responderOptions struct {
+	Serve   string
+	Webroot string
+	DNS     dnsOptions
+}
+
+func (o responderOptions) count() int {
+	n := 0
+	for _, set := range []bool{o.Serve != "", o.Webroot != "", o.DNS.Provider != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// check catches what would stop us answering the challenge before we register
+// the domain: a port we can't listen on, a document root we can't write to, or
+// a DNS provider that isn't set up right.
+func (o responderOptions) check() error {
+	if o.Serve != "" {
+		if l, err := listenChallenge(o.Serve); err != nil {
+			return err
+		} else {
+			l.Close()
+		}
+	} else if o.Webroot != "" {
+		w := exitWrapper(exitStorage, "can't write challenge files into "+o.Webroot)
+		if info, err := os.Stat(o.Webroot); err != nil {
+			return w(err)
+		} else if !info.IsDir() {
+			return w(errors.New("it isn't a directory"))
+		} else if f, err := ioutil.TempFile(o.Webroot, ".kycli-"); err != nil {
+			return w(err)
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	} else if o.DNS.Provider != "" {
+		if _, err := newDNSProvider(o.DNS); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	}
+	return nil
+}
+
+// respondToChallenge answers one of domain's challenges the way opts says
+// until domain validates or expires, then emits result with the outcome. If it
+// doesn't validate, only the error is emitted.
+func respondToChallenge(user *User, domain string, challenge domainChallenge, opts responderOptions, result map[string]interface{}) {
+	var stop func()
+	var err error
+	if opts.DNS.Provider != "" {
+		var provider dnsProvider
+		if challenge.Nonce == "" {
+			err = withExitCode(exitAPI, errors.New("the API didn't give us a TXT challenge for "+displayDomain(domain)))
+		} else if provider, err = newDNSProvider(opts.DNS); err != nil {
+			err = withExitCode(exitUsage, err)
+		} else if err = provider.Present(domain, challenge.Nonce); err == nil {
+			stop = func() {
+				if err := provider.CleanUp(domain, challenge.Nonce); err != nil {
+					fmt.Fprintln(os.Stderr, "Warning: couldn't remove the TXT record, so you'll have to:", err)
+				}
+			}
+			fmt.Println("Your domain name has been registered, and " + opts.DNS.Provider + " made the TXT record '" + challenge.Nonce + "' at " + displayDomain(domain) + ".")
+		}
+	} else if challenge.Path == "" || challenge.Content == "" {
+		err = withExitCode(exitAPI, errors.New("the API didn't give us a path challenge for "+displayDomain(domain)+"; make the TXT record '"+challenge.Nonce+"' at its root instead"))
+	} else if opts.Serve != "" {
+		if stop, err = serveChallenge(opts.Serve, challenge); err == nil {
+			fmt.Println("Your domain name has been registered, and kycli is answering its challenge on " + opts.Serve + ".")
+			fmt.Println("Make sure http://" + domain + challenge.Path + " reaches this machine.")
+		}
+	} else if stop, err = writeWebroot(opts.Webroot, challenge); err == nil {
+		fmt.Println("Your domain name has been registered, and the challenge file is at " + filepath.Join(opts.Webroot, filepath.FromSlash(challenge.Path)) + ".")
+		fmt.Println("Make sure your web server serves it at http://" + domain + challenge.Path + ".")
+	}
+	if err != nil {
+		fail(exitEnvironment, "Couldn't answer the challenge:", err)
+		return
+	}
+	fmt.Println("Waiting for UFKYC to validate the domain; press Ctrl-C to give up.")
+	status, err := awaitValidation(user, domain)
+	stop()
+	if err == errInterrupted {
+		fail(exitFailure, "Stopped answering the challenge before "+displayDomain(domain)+" validated; run this again within the hour to pick up where you left off.")
+	} else if err != nil {
+		fail(exitAPI, "Couldn't follow the domain's validation:", err)
+	} else if status.State != "validated" {
+		fail(exitFailure, describeDomainStatus(status))
+	} else {
+		result["status"] = status
+		emit(result)
+		fmt.Println(describeDomainStatus(status))
+	}
+}
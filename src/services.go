@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+)
+
+//We keep a copy of the services and domains you own, updated whenever the API
+//lists them for us and when you register them from this machine. It's used
+//for conveniences like shell completion; the API stays the source of truth.
+
+type Service struct {
+	gorm.Model
+	UserID    uint
+	ServiceID string `gorm:"column:service_id"`
+	// Alias is a name of the user's choosing for --service.
+	Alias string
+	// RequiredDonation and RegisteredAt are as of the last sync.
+	RequiredDonation float64
+	RegisteredAt     time.Time
+}
+
+type ServiceDomain struct {
+	gorm.Model
+	UserID uint
+	// ServiceID is the API's ID for the service, when we know it.
+	ServiceID string `gorm:"column:service_id"`
+	Name      string
+	// The challenges the API last gave us for validating the domain, for
+	// `service domain check`.
+	ValidationPath    string
+	ValidationContent string
+	TxtNonce          string
+	// State is pending, validated or expired as of the last sync, or empty if
+	// the API hasn't listed the domain yet.
+	State string
+}
+
+func recordService(user *User, serviceID string, alias string) error {
+	svc := Service{UserID: user.ID, ServiceID: serviceID, RegisteredAt: time.Now()}
+	if err := db.Save(&svc).Error; err != nil {
+		return errors.Wrap(err, "error saving service into local db")
+	} else if alias != "" {
+		return setServiceAlias(user, &svc, alias)
+	}
+	return nil
+}
+
+// setServiceAlias names svc, or takes its name away if alias is empty. Aliases
+// can't be mistaken for another of the user's services.
+func setServiceAlias(user *User, svc *Service, alias string) error {
+	if other, ok := findService(user, alias); alias != "" && ok && other.ID != svc.ID {
+		return withExitCode(exitUsage, errors.New("'"+alias+"' already means your service '"+other.ServiceID+"'"))
+	} else if strings.ContainsAny(alias, " \t\n") {
+		return withExitCode(exitUsage, errors.New("aliases can't have whitespace in them"))
+	}
+	svc.Alias = alias
+	return withExitCode(exitStorage, errors.Wrap(db.Save(svc).Error, "error saving service alias into local db"))
+}
+
+// recordServiceDomain remembers a domain registered for a service, along with
+// its challenges.
+func recordServiceDomain(user *User, serviceID string, name string, challenge domainChallenge) error {
+	w := errWrapper("error saving service domain into local db")
+	domain := ServiceDomain{UserID: user.ID, Name: name}
+	var existing []ServiceDomain
+	if err := db.Where(&domain).Limit(1).Find(&existing).Error; err != nil {
+		return w(err)
+	} else if len(existing) > 0 {
+		domain = existing[0]
+	}
+	domain.ServiceID = serviceID
+	domain.ValidationPath, domain.ValidationContent, domain.TxtNonce = challenge.Path, challenge.Content, challenge.Nonce
+	if err := db.Save(&domain).Error; err != nil {
+		return w(err)
+	}
+	return nil
+}
+
+// warnUnrecorded tells the user we couldn't remember something locally. The
+// command itself still succeeded, so it isn't a failure.
+func warnUnrecorded(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+}
+
+// domainChallenge is what the API wants to find to validate a domain: Content
+// served at Path over HTTP(S), or Nonce in a TXT record at the root.
+type domainChallenge struct {
+	Path    string `json:"path,omitempty"`
+	Content string `json:"content,omitempty"`
+	Nonce   string `json:"nonce,omitempty"`
+}
+
+// storedChallenge is the challenge we last saw for one of the user's domains.
+func storedChallenge(user *User, name string) (domainChallenge, bool) {
+	var domains []ServiceDomain
+	db.Where("user_id = ? AND name = ?", user.ID, name).Order("updated_at desc").Limit(1).Find(&domains)
+	if len(domains) == 0 {
+		return domainChallenge{}, false
+	}
+	return domainChallenge{Path: domains[0].ValidationPath, Content: domains[0].ValidationContent, Nonce: domains[0].TxtNonce}, true
+}
+
+// domainStatus is how far along a service domain is in validation.
+type domainStatus struct {
+	Domain    string `json:"domain"`
+	ServiceID string `json:"service_id"`
+	// State is pending, validated or expired.
+	State        string    `json:"state"`
+	RegisteredAt time.Time `json:"registered_at"`
+	// ExpiresAt is the end of the window for validating the domain.
+	ExpiresAt   time.Time `json:"expires_at"`
+	ValidatedAt time.Time `json:"validated_at,omitempty"`
+}
+
+// fetchDomainStatus asks the API about one of the user's domains, or all of
+// them if name is empty.
+func fetchDomainStatus(user *User, name string) ([]domainStatus, error) {
+	var resp struct {
+		Data  []domainStatus `json:"data"`
+		Error string         `json:"error"`
+	}
+	if r, err := user.PostForm("/service_domain_status", url.Values{
+		"domain_name": []string{name},
+	}); err != nil {
+		return nil, withExitCode(exitNetwork, errors.Wrap(err, "error contacting api for domain status"))
+	} else if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return nil, withExitCode(exitNetwork, errors.Wrap(err, "error reading api response body"))
+	} else if err := json.Unmarshal(b, &resp); err != nil && r.StatusCode == http.StatusOK {
+		return nil, withExitCode(exitAPI, errors.Wrap(err, "error unmarshaling domain status"))
+	} else if r.StatusCode != http.StatusOK && resp.Error != "" {
+		return nil, withExitCode(apiFailure(r.StatusCode), errors.New("the API returned an error: "+resp.Error))
+	} else if r.StatusCode != http.StatusOK {
+		return nil, withExitCode(apiFailure(r.StatusCode), errors.New("the API returned the status code "+r.Status+": "+strings.TrimSpace(string(b))))
+	} else {
+		return resp.Data, nil
+	}
+}
+
+// describeDomainStatus is a one line summary of d.
+func describeDomainStatus(d domainStatus) string {
+	switch d.State {
+	case "validated":
+		return displayDomain(d.Domain) + ": validated " + describeTime(d.ValidatedAt)
+	case "pending":
+		return displayDomain(d.Domain) + ": pending, " + time.Until(d.ExpiresAt).Round(time.Second).String() + " left to validate (until " + d.ExpiresAt.Local().Format(time.Kitchen) + ")"
+	case "expired":
+		return displayDomain(d.Domain) + ": expired " + describeTime(d.ExpiresAt) + "; register it again to start over"
+	default:
+		return displayDomain(d.Domain) + ": " + d.State
+	}
+}
+
+// serviceListing is how the API describes one of the user's services.
+type serviceListing struct {
+	ID string `json:"id"`
+	// Alias is ours rather than the API's.
+	Alias            string         `json:"alias,omitempty"`
+	RequiredDonation float64        `json:"required_donation"`
+	RegisteredAt     time.Time      `json:"registered_at"`
+	Domains          []domainStatus `json:"domains"`
+}
+
+// syncServices asks the API for the user's services and brings our copy up to
+// date with them: services and domains it no longer lists are forgotten.
+func syncServices(user *User) ([]serviceListing, error) {
+	var resp struct {
+		Data []serviceListing `json:"data"`
+	}
+	if r, err := user.PostForm("/list_services", url.Values{}); err != nil {
+		return nil, withExitCode(exitNetwork, errors.Wrap(err, "error contacting api for service list"))
+	} else if b, err := ioutil.ReadAll(r.Body); err != nil {
+		return nil, withExitCode(exitNetwork, errors.Wrap(err, "error reading api response body"))
+	} else if r.StatusCode != http.StatusOK {
+		return nil, withExitCode(apiFailure(r.StatusCode), errors.New("the API returned the status code "+r.Status+": "+strings.TrimSpace(string(b))))
+	} else if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, withExitCode(exitAPI, errors.Wrap(err, "error unmarshaling service list"))
+	}
+	w := exitWrapper(exitStorage, "error saving service list into local db")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		ids, names := []string{}, []string{}
+		for i, l := range resp.Data {
+			ids = append(ids, l.ID)
+			//Find rather than First, which logs "record not found" for new ones.
+			svc := Service{UserID: user.ID, ServiceID: l.ID}
+			var existing []Service
+			if err := tx.Where(&svc).Limit(1).Find(&existing).Error; err != nil {
+				return err
+			} else if len(existing) > 0 {
+				svc = existing[0]
+			}
+			svc.RequiredDonation, svc.RegisteredAt = l.RequiredDonation, l.RegisteredAt
+			if err := tx.Save(&svc).Error; err != nil {
+				return err
+			}
+			resp.Data[i].Alias = svc.Alias
+			for _, d := range l.Domains {
+				names = append(names, d.Domain)
+				domain := ServiceDomain{UserID: user.ID, Name: d.Domain}
+				var existing []ServiceDomain
+				if err := tx.Where(&domain).Limit(1).Find(&existing).Error; err != nil {
+					return err
+				} else if len(existing) > 0 {
+					domain = existing[0]
+				}
+				domain.ServiceID, domain.State = l.ID, d.State
+				if err := tx.Save(&domain).Error; err != nil {
+					return err
+				}
+			}
+		}
+		//NOT IN an empty list matches nothing in sqlite, rather than everything.
+		gone := tx.Where("user_id = ?", user.ID)
+		if len(ids) > 0 {
+			gone = gone.Where("service_id NOT IN ?", ids)
+		}
+		if err := gone.Delete(&Service{}).Error; err != nil {
+			return err
+		}
+		gone = tx.Where("user_id = ?", user.ID)
+		if len(names) > 0 {
+			gone = gone.Where("name NOT IN ?", names)
+		}
+		return gone.Delete(&ServiceDomain{}).Error
+	})
+	return resp.Data, w(err)
+}
+
+// describeService is a one line summary of l.
+func describeService(l serviceListing) string {
+	counts := map[string]int{}
+	for _, d := range l.Domains {
+		counts[d.State]++
+	}
+	line := l.ID
+	if l.Alias != "" {
+		line += " (" + l.Alias + ")"
+	}
+	line += ": registered " + describeTime(l.RegisteredAt) + ", "
+	if l.RequiredDonation > 0 {
+		line += fmt.Sprintf("requires donations of %0.2f$, ", l.RequiredDonation)
+	} else {
+		line += "no donation required, "
+	}
+	return line + fmt.Sprintf("%d domains (%d validated, %d pending, %d expired)", len(l.Domains), counts["validated"], counts["pending"], counts["expired"])
+}
+
+// findService looks for one of the user's services by ID or alias in our copy.
+func findService(user *User, idOrAlias string) (Service, bool) {
+	var services []Service
+	db.Where("user_id = ? AND (service_id = ? OR alias = ?)", user.ID, idOrAlias, idOrAlias).Limit(1).Find(&services)
+	if len(services) == 0 {
+		return Service{}, false
+	}
+	return services[0], true
+}
+
+// selectService picks the service a command acts on: the one given with
+// --service, else the profile's default, else the only one the user owns.
+// With several services and neither, it refuses to guess.
+func selectService(user *User, idOrAlias string) (Service, error) {
+	if idOrAlias == "" && conf != nil {
+		idOrAlias = conf.DefaultService
+	}
+	if idOrAlias != "" {
+		if svc, ok := findService(user, idOrAlias); ok {
+			return svc, nil
+		}
+		//It may have been registered from another machine.
+		if _, err := syncServices(user); err != nil {
+			return Service{}, err
+		} else if svc, ok := findService(user, idOrAlias); ok {
+			return svc, nil
+		}
+		return Service{}, withExitCode(exitUsage, errors.New("you don't own a service with the ID or alias '"+idOrAlias+"'; `kycli service list` shows the ones you do"))
+	}
+	if _, err := syncServices(user); err != nil {
+		return Service{}, err
+	}
+	var services []Service
+	if err := db.Where("user_id = ?", user.ID).Find(&services).Error; err != nil {
+		return Service{}, withExitCode(exitStorage, errors.Wrap(err, "error reading services from local db"))
+	} else if len(services) == 0 {
+		return Service{}, withExitCode(exitUsage, errors.New("you haven't registered a service; `kycli service register` makes one"))
+	} else if len(services) > 1 {
+		return Service{}, withExitCode(exitUsage, errors.Errorf("you own %d services, so pick one with --service, or set a default with `kycli service default`", len(services)))
+	}
+	return services[0], nil
+}
+
+// describeServiceName is a service's ID, with its alias if it has one.
+func describeServiceName(svc Service) string {
+	if svc.Alias != "" {
+		return "'" + svc.ServiceID + "' (" + svc.Alias + ")"
+	}
+	return "'" + svc.ServiceID + "'"
+}
+
+// registerServiceFlag adds --service to commands that act on one service.
+func registerServiceFlag(cmd *cobra.Command, idOrAlias *string) {
+	cmd.Flags().StringVar(idOrAlias, "service", "", "ID or alias of the service to act on (default the profile's default service, or your only one)")
+	cmd.RegisterFlagCompletionFunc("service", completeServiceIDs)
+}
@@ -10,20 +10,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-func isRootDomain(name string) bool {
-	n := []rune(name)
-	var count int
-	for _, v := range n {
-		if v == '.' {
-			count++
-			if count > 1 {
-				return false
-			}
-		}
-	}
-	return true
-}
-
 func printErr(err error) {
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,172 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Token is a decoded, but not yet verified, public PASETO.
+type Token struct {
+	Header    string
+	Message   []byte
+	Signature []byte
+	Footer    []byte
+}
+
+// Parse decodes a v2.public or v4.public PASETO without checking its
+// signature. Use a Verifier unless you really just want to look inside.
+func Parse(token string) (*Token, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 && len(parts) != 4 {
+		return nil, errors.Wrap(ErrMalformed, "a paseto token has three or four dot separated sections")
+	} else if parts[0] != "v2" && parts[0] != "v4" {
+		return nil, errors.Wrap(ErrMalformed, "unsupported paseto version '"+parts[0]+"'")
+	} else if parts[1] != "public" {
+		return nil, errors.Wrap(ErrMalformed, "unsupported paseto purpose '"+parts[1]+"'; UFKYC tokens are public tokens")
+	} else if body, err := base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, errors.Wrap(ErrMalformed, "error decoding token body: "+err.Error())
+	} else if len(body) < ed25519.SignatureSize {
+		return nil, errors.Wrap(ErrMalformed, "token body is too short to contain a signature")
+	} else {
+		t := &Token{
+			Header:    parts[0] + "." + parts[1] + ".",
+			Message:   body[:len(body)-ed25519.SignatureSize],
+			Signature: body[len(body)-ed25519.SignatureSize:],
+		}
+		if len(parts) == 4 {
+			if t.Footer, err = base64.RawURLEncoding.DecodeString(parts[3]); err != nil {
+				return nil, errors.Wrap(ErrMalformed, "error decoding token footer: "+err.Error())
+			}
+		}
+		return t, nil
+	}
+}
+
+// Version returns "v2.public" or "v4.public".
+func (t *Token) Version() string {
+	return strings.TrimSuffix(t.Header, ".")
+}
+
+// pae is the paseto "pre-authentication encoding" that gets signed.
+func pae(pieces ...[]byte) []byte {
+	var buf bytes.Buffer
+	le64 := func(n int) {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(n)&^(1<<63))
+		buf.Write(b)
+	}
+	le64(len(pieces))
+	for _, p := range pieces {
+		le64(len(p))
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+func signedBytes(header string, message, footer []byte) []byte {
+	if header == "v4.public." {
+		//We don't use implicit assertions, but v4 still signs an empty one.
+		return pae([]byte(header), message, footer, []byte{})
+	}
+	return pae([]byte(header), message, footer)
+}
+
+// SignedBy returns the index of the key that signed the token, or -1.
+func (t *Token) SignedBy(keys []ed25519.PublicKey) int {
+	signed := signedBytes(t.Header, t.Message, t.Footer)
+	for i, k := range keys {
+		if ed25519.Verify(k, signed, t.Signature) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Claims unmarshals the token's message. The claims are only trustworthy if
+// SignedBy found a key.
+func (t *Token) Claims() (*Claims, error) {
+	var c Claims
+	if err := json.Unmarshal(t.Message, &c); err != nil {
+		return nil, errors.Wrap(ErrMalformed, "error unmarshaling token claims: "+err.Error())
+	}
+	return &c, nil
+}
+
+// Sign makes a v4.public token out of claims. The platform does this for
+// real tokens; it's exported so you can mint tokens for your own tests.
+func Sign(key ed25519.PrivateKey, claims *Claims, footer []byte) (string, error) {
+	if m, err := json.Marshal(claims); err != nil {
+		return "", errors.Wrap(err, "error marshaling token claims")
+	} else {
+		header := "v4.public."
+		sig := ed25519.Sign(key, signedBytes(header, m, footer))
+		token := header + base64.RawURLEncoding.EncodeToString(append(m, sig...))
+		if len(footer) > 0 {
+			token += "." + base64.RawURLEncoding.EncodeToString(footer)
+		}
+		return token, nil
+	}
+}
+
+// ParseKeys accepts hex, base64 or PEM encoded ed25519 public keys, one per
+// line, with '#' comments.
+func ParseKeys(b []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		var rest []byte
+		if block, rest = pem.Decode(b); block == nil {
+			break
+		} else if key, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, errors.Wrap(err, "error parsing pem encoded key")
+		} else if edKey, ok := key.(ed25519.PublicKey); !ok {
+			return nil, errors.New("pem encoded key is not an ed25519 key")
+		} else {
+			keys = append(keys, edKey)
+		}
+		b = rest
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var raw []byte
+		var err error
+		if raw, err = hex.DecodeString(line); err != nil {
+			if raw, err = base64.StdEncoding.DecodeString(line); err != nil {
+				if raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(line, "=")); err != nil {
+					return nil, errors.New("'" + line + "' is not a hex or base64 encoded key")
+				}
+			}
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, errors.New("'" + line + "' is not 32 bytes long, so it isn't an ed25519 public key")
+		}
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+// ReadKeyFile reads a file in the format ParseKeys accepts.
+func ReadKeyFile(path string) ([]ed25519.PublicKey, error) {
+	if b, err := ioutil.ReadFile(path); err != nil {
+		return nil, errors.Wrap(err, "error reading public key file")
+	} else if keys, err := ParseKeys(b); err != nil {
+		return nil, errors.Wrap(err, "error parsing public key file "+path)
+	} else {
+		return keys, nil
+	}
+}
@@ -0,0 +1,113 @@
+// Package verify checks UFKYC account tokens on behalf of a service.
+//
+// Users hand your service a token they got from `kycli token`. Before you
+// trust it you have to check that the platform signed it, that it was issued
+// for your service (its audience is the ID `kycli service register` gave
+// you), and that it hasn't expired. Then persist the subject; it's stable per
+// user and per service, so the same person can't sign up twice.
+//
+//	keys, err := verify.ReadKeyFile("/etc/myservice/ufkyc.pub")
+//	...
+//	v := verify.NewVerifier("my-service-id", keys...)
+//	claims, err := v.Verify(submittedToken)
+//	if errors.Is(err, verify.ErrExpired) {
+//		...
+//	}
+//
+// Everything works offline; fetching the platform keys is up to you.
+package verify
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrMalformed means the token couldn't even be decoded.
+	ErrMalformed = errors.New("malformed token")
+	// ErrBadSignature means none of the verifier's keys signed the token.
+	ErrBadSignature = errors.New("token signature is invalid")
+	// ErrWrongAudience means the token was issued for a different service.
+	ErrWrongAudience = errors.New("token was issued for a different service")
+	// ErrMissingSubject means the token doesn't identify a user.
+	ErrMissingSubject = errors.New("token has no subject")
+	// ErrExpired means the token's expiry has passed.
+	ErrExpired = errors.New("token has expired")
+	// ErrNotYetValid means the token's not-before time is in the future.
+	ErrNotYetValid = errors.New("token is not valid yet")
+)
+
+// Claims are the registered PASETO claims UFKYC puts into account tokens.
+type Claims struct {
+	Issuer string `json:"iss,omitempty"`
+	// Subject identifies the user, and is only stable within one service.
+	Subject string `json:"sub,omitempty"`
+	// Audience is the service ID the token was issued for.
+	Audience   string    `json:"aud,omitempty"`
+	Expiration time.Time `json:"exp,omitempty"`
+	NotBefore  time.Time `json:"nbf,omitempty"`
+	IssuedAt   time.Time `json:"iat,omitempty"`
+	TokenID    string    `json:"jti,omitempty"`
+}
+
+// Verifier checks tokens for a single service.
+type Verifier struct {
+	ServiceID string
+	Keys      []ed25519.PublicKey
+	// Leeway is the clock skew tolerated on expiry and not-before checks.
+	Leeway time.Duration
+	// Now defaults to time.Now; override it in tests.
+	Now func() time.Time
+}
+
+// NewVerifier makes a Verifier for serviceID that trusts any of keys.
+func NewVerifier(serviceID string, keys ...ed25519.PublicKey) *Verifier {
+	return &Verifier{
+		ServiceID: serviceID,
+		Keys:      keys,
+		Leeway:    30 * time.Second,
+	}
+}
+
+// NewVerifierFromKeyFile is NewVerifier with the keys read by ReadKeyFile.
+func NewVerifierFromKeyFile(serviceID string, path string) (*Verifier, error) {
+	if keys, err := ReadKeyFile(path); err != nil {
+		return nil, err
+	} else {
+		return NewVerifier(serviceID, keys...), nil
+	}
+}
+
+// Verify returns the token's claims if it's genuine, meant for this service
+// and currently valid. Errors wrap one of the Err* values above, so use
+// errors.Is to tell them apart. When only the audience, subject or validity
+// period is wrong, the decoded claims are returned alongside the error.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	if v.ServiceID == "" {
+		return nil, errors.New("verifier has no service ID configured")
+	} else if len(v.Keys) == 0 {
+		return nil, errors.New("verifier has no public keys configured")
+	} else if t, err := Parse(token); err != nil {
+		return nil, err
+	} else if t.SignedBy(v.Keys) < 0 {
+		return nil, ErrBadSignature
+	} else if c, err := t.Claims(); err != nil {
+		return nil, err
+	} else if c.Audience != v.ServiceID {
+		return c, errors.Wrap(ErrWrongAudience, "token audience is '"+c.Audience+"'")
+	} else if c.Subject == "" {
+		return c, ErrMissingSubject
+	} else if c.Expiration.IsZero() || now.After(c.Expiration.Add(v.Leeway)) {
+		return c, errors.Wrap(ErrExpired, "token expired at "+c.Expiration.Format(time.RFC3339))
+	} else if !c.NotBefore.IsZero() && now.Add(v.Leeway).Before(c.NotBefore) {
+		return c, errors.Wrap(ErrNotYetValid, "token is valid from "+c.NotBefore.Format(time.RFC3339))
+	} else {
+		return c, nil
+	}
+}
@@ -0,0 +1,152 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The key pair of the published PASETO test vectors, from
+// github.com/paseto-standard/test-vectors.
+var (
+	vectorSecret, _ = hex.DecodeString("b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a37741eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2")
+	vectorKey       = ed25519.PrivateKey(vectorSecret).Public().(ed25519.PublicKey)
+)
+
+func TestPublishedVectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		payload string
+		footer  string
+	}{
+		{
+			"2-S-1",
+			"v2.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwaXJlcyI6IjIwMTktMDEtMDFUMDA6MDA6MDArMDA6MDAifSUGY_L1YtOvo1JeNVAWQkOBILGSjtkX_9-g2pVPad7_SAyejb6Q2TDOvfCOpWYH5DaFeLOwwpTnaTXeg8YbUwI",
+			`{"data":"this is a signed message","expires":"2019-01-01T00:00:00+00:00"}`,
+			"",
+		},
+		{
+			"2-S-2",
+			"v2.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwaXJlcyI6IjIwMTktMDEtMDFUMDA6MDA6MDArMDA6MDAifcMYjoUaEYXAtzTDwlcOlxdcZWIZp8qZga3jFS8JwdEjEvurZhs6AmTU3bRW5pB9fOQwm43rzmibZXcAkQ4AzQs.UGFyYWdvbiBJbml0aWF0aXZlIEVudGVycHJpc2Vz",
+			`{"data":"this is a signed message","expires":"2019-01-01T00:00:00+00:00"}`,
+			"Paragon Initiative Enterprises",
+		},
+		{
+			"4-S-1",
+			"v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA",
+			`{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`,
+			"",
+		},
+		{
+			"4-S-2",
+			"v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9v3Jt8mx_TdM2ceTGoqwrh4yDFn0XsHvvV_D0DtwQxVrJEBMl0F2caAdgnpKlt4p7xBnx1HcO-SPo8FPp214HDw.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9",
+			`{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`,
+			`{"kid":"zVhMiPBP9fRf2snEcT7gFTioeA9COcNy9DfgL1W60haN"}`,
+		},
+	}
+	for _, tt := range tests {
+		tok, err := Parse(tt.token)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		} else if string(tok.Message) != tt.payload || string(tok.Footer) != tt.footer {
+			t.Errorf("%s: parsed %q with footer %q", tt.name, tok.Message, tok.Footer)
+		}
+		if i := tok.SignedBy([]ed25519.PublicKey{vectorKey}); i != 0 {
+			t.Errorf("%s: the vector key didn't verify the signature", tt.name)
+		}
+		//v2 and v4 sign different pre-authentication encodings, so a token
+		//relabelled as the other version mustn't verify.
+		if tok.Header == "v2.public." {
+			tok.Header = "v4.public."
+		} else {
+			tok.Header = "v2.public."
+		}
+		if tok.SignedBy([]ed25519.PublicKey{vectorKey}) >= 0 {
+			t.Errorf("%s: verified as %s too", tt.name, tok.Version())
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	_, other, _ := ed25519.GenerateKey(nil)
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	claims := func(edit func(c *Claims)) *Claims {
+		c := &Claims{Issuer: "ufkyc", Subject: "user-1", Audience: "svc", Expiration: now.Add(time.Hour), NotBefore: now.Add(-time.Minute)}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	sign := func(key ed25519.PrivateKey, c *Claims, footer string) string {
+		token, err := Sign(key, c, []byte(footer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	//signV2 signs the same way the platform's v2 tokens were.
+	signV2 := func(c *Claims) string {
+		v4, _ := Parse(sign(ed25519.PrivateKey(vectorSecret), c, ""))
+		sig := ed25519.Sign(ed25519.PrivateKey(vectorSecret), pae([]byte("v2.public."), v4.Message, nil))
+		return "v2.public." + base64.RawURLEncoding.EncodeToString(append(v4.Message, sig...))
+	}
+	good := sign(ed25519.PrivateKey(vectorSecret), claims(nil), "")
+	withFooter := sign(ed25519.PrivateKey(vectorSecret), claims(nil), `{"kid":"a"}`)
+	unfooted := withFooter[:strings.LastIndex(withFooter, ".")]
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"good", good, nil},
+		{"good with footer", withFooter, nil},
+		{"v2", signV2(claims(nil)), nil},
+		{"wrong key", sign(other, claims(nil), ""), ErrBadSignature},
+		{"bad signature", good[:len(good)-4] + "AAAA", ErrBadSignature},
+		{"changed claims", "v4.public." + base64.RawURLEncoding.EncodeToString(append([]byte(`{"sub":"user-2","aud":"svc"}`), make([]byte, 64)...)), ErrBadSignature},
+		{"footer mismatch", unfooted + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"kid":"b"}`)), ErrBadSignature},
+		{"footer dropped", unfooted, ErrBadSignature},
+		{"v4 relabelled v2", "v2" + strings.TrimPrefix(good, "v4"), ErrBadSignature},
+		{"wrong audience", sign(ed25519.PrivateKey(vectorSecret), claims(func(c *Claims) { c.Audience = "other" }), ""), ErrWrongAudience},
+		{"no subject", sign(ed25519.PrivateKey(vectorSecret), claims(func(c *Claims) { c.Subject = "" }), ""), ErrMissingSubject},
+		{"expired", sign(ed25519.PrivateKey(vectorSecret), claims(func(c *Claims) { c.Expiration = now.Add(-time.Minute) }), ""), ErrExpired},
+		{"expired within leeway", sign(ed25519.PrivateKey(vectorSecret), claims(func(c *Claims) { c.Expiration = now.Add(-10 * time.Second) }), ""), nil},
+		{"no expiry", sign(ed25519.PrivateKey(vectorSecret), claims(func(c *Claims) { c.Expiration = time.Time{} }), ""), ErrExpired},
+		{"not yet valid", sign(ed25519.PrivateKey(vectorSecret), claims(func(c *Claims) { c.NotBefore = now.Add(time.Minute) }), ""), ErrNotYetValid},
+		{"not yet valid within leeway", sign(ed25519.PrivateKey(vectorSecret), claims(func(c *Claims) { c.NotBefore = now.Add(10 * time.Second) }), ""), nil},
+		{"malformed", "v4.public.!!!", ErrMalformed},
+		{"local token", "v4.local." + strings.TrimPrefix(good, "v4.public."), ErrMalformed},
+	}
+	v := NewVerifier("svc", vectorKey)
+	v.Now = func() time.Time { return now }
+	for _, tt := range tests {
+		c, err := v.Verify(tt.token)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if tt.want == nil && (c == nil || c.Subject != "user-1") {
+			t.Errorf("%s: got claims %+v", tt.name, c)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	token, err := Sign(ed25519.PrivateKey(vectorSecret), &Claims{Subject: "s"}, []byte("f"))
+	if err != nil {
+		t.Fatal(err)
+	} else if tok, err := Parse(token); err != nil {
+		t.Fatal(err)
+	} else if tok.Version() != "v4.public" || !bytes.Equal(tok.Footer, []byte("f")) {
+		t.Errorf("signed %s token with footer %q", tok.Version(), tok.Footer)
+	} else if tok.SignedBy([]ed25519.PublicKey{vectorKey}) != 0 {
+		t.Error("Sign's token didn't verify")
+	}
+}